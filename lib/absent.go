@@ -0,0 +1,136 @@
+package terraspec
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/terraform/configs/configschema"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// presence records the attributes written in the body of an assertion, whatever their value,
+// and the presence of the nested blocks written in it.
+// Attributes written with a null value, literal or evaluated, must be absent instead of being
+// ignored like attributes without spec
+type presence struct {
+	attributes map[string]*hcl.Attribute
+	blocks     map[string][]*presence
+}
+
+// readPresence lists the attributes and nested blocks of body without decoding nor altering it.
+// Nested block types may be written as attributes, to be set to null or absent()
+func readPresence(body hcl.Body, schema *configschema.Block) *presence {
+	bodySchema := &hcl.BodySchema{}
+	for name := range schema.Attributes {
+		bodySchema.Attributes = append(bodySchema.Attributes, hcl.AttributeSchema{Name: name})
+	}
+	for name, nested := range schema.BlockTypes {
+		bodySchema.Attributes = append(bodySchema.Attributes, hcl.AttributeSchema{Name: name})
+		if nested.Nesting == configschema.NestingMap {
+			bodySchema.Blocks = append(bodySchema.Blocks, hcl.BlockHeaderSchema{Type: name, LabelNames: []string{"key"}})
+		} else {
+			bodySchema.Blocks = append(bodySchema.Blocks, hcl.BlockHeaderSchema{Type: name})
+		}
+	}
+	// errors are reported when decoding the body
+	content, _, _ := body.PartialContent(bodySchema)
+	p := &presence{attributes: content.Attributes, blocks: make(map[string][]*presence)}
+	for _, block := range content.Blocks {
+		if block.Type == "reject" || block.Type == "return" {
+			continue
+		}
+		nested := schema.BlockTypes[block.Type]
+		switch nested.Nesting {
+		case configschema.NestingSingle, configschema.NestingGroup, configschema.NestingList:
+			p.blocks[block.Type] = append(p.blocks[block.Type], readPresence(block.Body, &nested.Block))
+		}
+	}
+	return p
+}
+
+// decodeSchema returns the schema decoding the bodies described by presences : nested block types
+// written as attributes are decoded as attributes
+func decodeSchema(schema *configschema.Block, presences []*presence) *configschema.Block {
+	decode := &configschema.Block{
+		Attributes: make(map[string]*configschema.Attribute, len(schema.Attributes)),
+		BlockTypes: make(map[string]*configschema.NestedBlock, len(schema.BlockTypes)),
+	}
+	for name, attr := range schema.Attributes {
+		decode.Attributes[name] = attr
+	}
+	for name, nested := range schema.BlockTypes {
+		var blocks []*presence
+		asAttribute := false
+		for _, p := range presences {
+			_, found := p.attributes[name]
+			asAttribute = asAttribute || found
+			blocks = append(blocks, p.blocks[name]...)
+		}
+		switch {
+		case asAttribute:
+			decode.Attributes[name] = &configschema.Attribute{Type: cty.DynamicPseudoType, Optional: true}
+		case len(blocks) > 0:
+			decode.BlockTypes[name] = &configschema.NestedBlock{Block: *decodeSchema(&nested.Block, blocks), MinItems: nested.MinItems, MaxItems: nested.MaxItems, Nesting: nested.Nesting}
+		default:
+			decode.BlockTypes[name] = nested
+		}
+	}
+	return decode
+}
+
+// apply marks the null attributes present in the body as absent in the value decoded from it with decoded,
+// and gives back their type to the nested blocks decoded as attributes
+func (p *presence) apply(val cty.Value, schema, decoded *configschema.Block) (cty.Value, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	if val.IsMarked() || !val.IsKnown() || val.IsNull() || !val.Type().IsObjectType() {
+		return val, diags
+	}
+	attrs := val.AsValueMap()
+	for name := range schema.Attributes {
+		if _, present := p.attributes[name]; present && !attrs[name].IsMarked() && attrs[name].IsNull() {
+			attrs[name] = attrs[name].Mark(absentMatcher)
+		}
+	}
+	for name, nested := range schema.BlockTypes {
+		if _, asAttribute := decoded.Attributes[name]; asAttribute {
+			typed := cty.NullVal(schema.ImpliedType().AttributeType(name))
+			if attr, present := p.attributes[name]; present {
+				if unmarked, _ := attrs[name].Unmark(); !unmarked.IsNull() {
+					diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Unsupported argument", Subject: attr.Expr.Range().Ptr(), Detail: fmt.Sprintf("Block \"%s\" can only be set to null or absent() as an argument", name)})
+					continue
+				}
+				typed = typed.Mark(absentMatcher)
+			}
+			attrs[name] = typed
+			continue
+		}
+		blocks := p.blocks[name]
+		if len(blocks) == 0 {
+			continue
+		}
+		nestedDecoded := &decoded.BlockTypes[name].Block
+		switch nested.Nesting {
+		case configschema.NestingSingle, configschema.NestingGroup:
+			var moreDiags hcl.Diagnostics
+			attrs[name], moreDiags = blocks[0].apply(attrs[name], &nested.Block, nestedDecoded)
+			diags = append(diags, moreDiags...)
+		case configschema.NestingList:
+			list := attrs[name]
+			if list.IsMarked() || !list.IsKnown() || list.IsNull() || list.LengthInt() != len(blocks) {
+				continue
+			}
+			elems := list.AsValueSlice()
+			for i := range elems {
+				var moreDiags hcl.Diagnostics
+				elems[i], moreDiags = blocks[i].apply(elems[i], &nested.Block, nestedDecoded)
+				diags = append(diags, moreDiags...)
+			}
+			if list.Type().IsListType() {
+				attrs[name] = cty.ListVal(elems)
+			} else {
+				attrs[name] = cty.TupleVal(elems)
+			}
+		}
+	}
+	return cty.ObjectVal(attrs), diags
+}
@@ -0,0 +1,71 @@
+package terraspec
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/terraform/configs/configschema"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// AutoMockValue builds a plausible result for a data source call that wasn't mocked.
+// Attributes set in config are kept as is and computed attributes are set with placeholder values
+func AutoMockValue(schema *configschema.Block, config cty.Value) cty.Value {
+	if config.IsNull() || !config.IsKnown() {
+		config = cty.NullVal(schema.ImpliedType())
+	}
+	vals := make(map[string]cty.Value, len(schema.Attributes)+len(schema.BlockTypes))
+	for name, attr := range schema.Attributes {
+		var v cty.Value
+		if !config.IsNull() {
+			v = config.GetAttr(name)
+		} else {
+			v = cty.NullVal(attr.Type)
+		}
+		if v.IsNull() && attr.Computed {
+			v = placeholderValue(name, attr.Type)
+		}
+		vals[name] = v
+	}
+	for name, block := range schema.BlockTypes {
+		if !config.IsNull() {
+			vals[name] = config.GetAttr(name)
+		} else {
+			vals[name] = cty.NullVal(block.ImpliedType())
+		}
+	}
+	return cty.ObjectVal(vals)
+}
+
+// placeholderValue returns a non null value of the given type :
+// "mock-<name>" strings, zero numbers, false booleans and collections of one placeholder element
+func placeholderValue(name string, t cty.Type) cty.Value {
+	switch {
+	case t == cty.String:
+		return cty.StringVal(fmt.Sprintf("mock-%s", name))
+	case t == cty.Number:
+		return cty.Zero
+	case t == cty.Bool:
+		return cty.False
+	case t.IsListType():
+		return cty.ListVal([]cty.Value{placeholderValue(name, t.ElementType())})
+	case t.IsSetType():
+		return cty.SetVal([]cty.Value{placeholderValue(name, t.ElementType())})
+	case t.IsMapType():
+		return cty.MapVal(map[string]cty.Value{"mock": placeholderValue(name, t.ElementType())})
+	case t.IsObjectType():
+		vals := make(map[string]cty.Value, len(t.AttributeTypes()))
+		for k, at := range t.AttributeTypes() {
+			vals[k] = placeholderValue(k, at)
+		}
+		return cty.ObjectVal(vals)
+	case t.IsTupleType():
+		vals := make([]cty.Value, len(t.TupleElementTypes()))
+		for i, et := range t.TupleElementTypes() {
+			vals[i] = placeholderValue(name, et)
+		}
+		return cty.TupleVal(vals)
+	default:
+		// dynamic values can't be guessed
+		return cty.NullVal(t)
+	}
+}
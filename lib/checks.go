@@ -0,0 +1,217 @@
+package terraspec
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/terraform/addrs"
+	"github.com/hashicorp/terraform/plans"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/hashicorp/terraform/tfdiags"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+)
+
+// Check struct contains a condition on the whole plan, like a rule spanning several resources.
+// The condition and error message are evaluated with the planned values available by address
+type Check struct {
+	Name         string
+	Condition    hcl.Expression
+	ErrorMessage hcl.Expression
+	ctx          *hcl.EvalContext
+}
+
+// checkSchema is the schema of the body of check blocks
+var checkSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "condition", Required: true},
+		{Name: "error_message"},
+	},
+}
+
+// decodeCheck reads the condition and error message of a check block, to be evaluated once the plan is known
+func decodeCheck(name string, body hcl.Body, ctx *hcl.EvalContext) (*Check, hcl.Diagnostics) {
+	content, diags := body.Content(checkSchema)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	check := &Check{Name: name, Condition: content.Attributes["condition"].Expr, ctx: ctx}
+	if errorMessage, ok := content.Attributes["error_message"]; ok {
+		check.ErrorMessage = errorMessage.Expr
+	}
+	return check, diags
+}
+
+// validateCheck evaluates the condition of the check against the planned values
+func validateCheck(check *Check, planned map[string]cty.Value) tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+	path := cty.GetAttrPath("check").GetAttr(check.Name)
+	ctx := check.ctx.NewChild()
+	ctx.Variables = planned
+
+	val, hclDiags := check.Condition.Value(ctx)
+	if hclDiags.HasErrors() {
+		return diags.Append(hclDiags)
+	}
+	val, _ = val.UnmarkDeep()
+	if !val.IsKnown() {
+		return diags.Append(ErrorDiags(path, "condition is known after apply"))
+	}
+	if val.IsNull() {
+		return diags.Append(ErrorDiags(path, "condition must be true or false, got null"))
+	}
+	condition, err := convert.Convert(val, cty.Bool)
+	if err != nil {
+		return diags.Append(ErrorDiags(path, fmt.Sprintf("condition must be true or false : %s", tfdiags.FormatError(err))))
+	}
+	if condition.True() {
+		return diags.Append(SuccessDiags(path, "condition is true"))
+	}
+
+	message, hclDiags := decodeErrorMessage(check.ErrorMessage, ctx)
+	if hclDiags.HasErrors() {
+		return diags.Append(hclDiags)
+	}
+	return withErrorMessage(diags.Append(ErrorDiags(path, "condition is false")), message)
+}
+
+// plannedValues returns the values of the plan, as they're referenced in the conditions of checks :
+// resources as <type>.<name>, data sources as data.<type>.<name>, outputs as output.<name>
+// and outputs of child modules as module.<name>.<output>.
+// Resources with count or for_each are lists or maps of their instances
+func plannedValues(plan *plans.Plan, schemas *terraform.Schemas) (map[string]cty.Value, error) {
+	resources := make(map[addrs.Resource]map[addrs.InstanceKey]cty.Value)
+	addInstance := func(addr addrs.ResourceInstance, val cty.Value) {
+		if resources[addr.Resource] == nil {
+			resources[addr.Resource] = make(map[addrs.InstanceKey]cty.Value)
+		}
+		resources[addr.Resource][addr.Key] = val
+	}
+
+	for _, resource := range plan.Changes.Resources {
+		if !resource.Addr.Module.IsRoot() || resource.Action == plans.Delete {
+			continue
+		}
+		addr := resource.Addr.Resource
+		schema, _ := schemas.ResourceTypeConfig(resource.ProviderAddr.Provider, addr.Resource.Mode, addr.Resource.Type)
+		if schema == nil {
+			return nil, fmt.Errorf("Could not find schema of resource %s", resource.Addr.String())
+		}
+		after, err := resource.After.Decode(schema.ImpliedType())
+		if err != nil {
+			return nil, fmt.Errorf("Error happened while decoding planned resource %s : %v", resource.Addr.String(), err)
+		}
+		addInstance(addr, after)
+	}
+
+	// data sources read at plan time are only found in the refreshed state
+	if plan.State != nil {
+		if module := plan.State.Module(addrs.RootModuleInstance); module != nil {
+			for _, resource := range module.Resources {
+				if resource.Addr.Resource.Mode != addrs.DataResourceMode {
+					continue
+				}
+				schema, _ := schemas.ResourceTypeConfig(resource.ProviderConfig.Provider, addrs.DataResourceMode, resource.Addr.Resource.Type)
+				if schema == nil {
+					return nil, fmt.Errorf("Could not find schema of data source %s", resource.Addr.String())
+				}
+				for key, instance := range resource.Instances {
+					addr := resource.Addr.Resource.Instance(key)
+					if _, planned := resources[addr.Resource][key]; planned || instance.Current == nil {
+						continue
+					}
+					obj, err := instance.Current.Decode(schema.ImpliedType())
+					if err != nil {
+						return nil, fmt.Errorf("Error happened while decoding data source %s : %v", addr.String(), err)
+					}
+					addInstance(addr, obj.Value)
+				}
+			}
+		}
+	}
+
+	managed := make(map[string]map[string]cty.Value)
+	data := make(map[string]map[string]cty.Value)
+	for addr, instances := range resources {
+		byType := managed
+		if addr.Mode == addrs.DataResourceMode {
+			byType = data
+		}
+		if byType[addr.Type] == nil {
+			byType[addr.Type] = make(map[string]cty.Value)
+		}
+		byType[addr.Type][addr.Name] = instancesValue(instances)
+	}
+
+	outputs := make(map[string]cty.Value)
+	modules := make(map[string]map[addrs.InstanceKey]map[string]cty.Value)
+	for _, output := range plan.Changes.Outputs {
+		if output.Action == plans.Delete || len(output.Addr.Module) > 1 {
+			continue
+		}
+		change, err := output.Decode()
+		if err != nil {
+			return nil, fmt.Errorf("Error happened while decoding planned output %s : %v", output.Addr.String(), err)
+		}
+		if output.Addr.Module.IsRoot() {
+			outputs[output.Addr.OutputValue.Name] = change.After
+			continue
+		}
+		call := output.Addr.Module[0]
+		if modules[call.Name] == nil {
+			modules[call.Name] = make(map[addrs.InstanceKey]map[string]cty.Value)
+		}
+		if modules[call.Name][call.InstanceKey] == nil {
+			modules[call.Name][call.InstanceKey] = make(map[string]cty.Value)
+		}
+		modules[call.Name][call.InstanceKey][output.Addr.OutputValue.Name] = change.After
+	}
+
+	planned := make(map[string]cty.Value, len(managed)+3)
+	for resourceType, names := range managed {
+		planned[resourceType] = cty.ObjectVal(names)
+	}
+	dataTypes := make(map[string]cty.Value, len(data))
+	for dataType, names := range data {
+		dataTypes[dataType] = cty.ObjectVal(names)
+	}
+	planned["data"] = cty.ObjectVal(dataTypes)
+	planned["output"] = cty.ObjectVal(outputs)
+	calls := make(map[string]cty.Value, len(modules))
+	for name, instances := range modules {
+		values := make(map[addrs.InstanceKey]cty.Value, len(instances))
+		for key, outputs := range instances {
+			values[key] = cty.ObjectVal(outputs)
+		}
+		calls[name] = instancesValue(values)
+	}
+	planned["module"] = cty.ObjectVal(calls)
+	return planned, nil
+}
+
+// instancesValue returns the value of a resource or module from the ones of its instances, like terraform does :
+// the value of the single instance, a tuple of the instances created with count
+// or an object of the instances created with for_each
+func instancesValue(instances map[addrs.InstanceKey]cty.Value) cty.Value {
+	if val, ok := instances[addrs.NoKey]; ok {
+		return val
+	}
+	keys := make([]addrs.InstanceKey, 0, len(instances))
+	for key := range instances {
+		keys = append(keys, key)
+	}
+	if _, ok := keys[0].(addrs.IntKey); ok {
+		sort.Slice(keys, func(i, j int) bool { return keys[i].(addrs.IntKey) < keys[j].(addrs.IntKey) })
+		elems := make([]cty.Value, 0, len(keys))
+		for _, key := range keys {
+			elems = append(elems, instances[key])
+		}
+		return cty.TupleVal(elems)
+	}
+	attrs := make(map[string]cty.Value, len(keys))
+	for _, key := range keys {
+		attrs[string(key.(addrs.StringKey))] = instances[key]
+	}
+	return cty.ObjectVal(attrs)
+}
@@ -0,0 +1,185 @@
+package terraspec
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/addrs"
+	"github.com/hashicorp/terraform/configs/configschema"
+	"github.com/hashicorp/terraform/plans"
+	"github.com/hashicorp/terraform/states"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/hashicorp/terraform/tfdiags"
+	"github.com/zclconf/go-cty/cty"
+)
+
+var checksSchemas = &terraform.Schemas{
+	Providers: map[addrs.Provider]*terraform.ProviderSchema{
+		addrs.NewDefaultProvider("aws"): {
+			ResourceTypes: map[string]*configschema.Block{
+				"aws_s3_bucket": {
+					Attributes: map[string]*configschema.Attribute{
+						"bucket": {Type: cty.String, Optional: true},
+						"tags":   {Type: cty.Map(cty.String), Optional: true},
+					},
+				},
+				"aws_s3_bucket_public_access_block": {
+					Attributes: map[string]*configschema.Attribute{
+						"bucket": {Type: cty.String, Optional: true},
+					},
+				},
+			},
+			DataSources: map[string]*configschema.Block{
+				"aws_caller_identity": {
+					Attributes: map[string]*configschema.Attribute{
+						"account_id": {Type: cty.String, Computed: true},
+					},
+				},
+			},
+		},
+	},
+}
+
+func checksPlan(t *testing.T) *plans.Plan {
+	provider := addrs.AbsProviderConfig{Module: addrs.RootModule, Provider: addrs.NewDefaultProvider("aws")}
+	change := func(resourceType string, key addrs.InstanceKey, module addrs.ModuleInstance, after cty.Value) *plans.ResourceInstanceChangeSrc {
+		ty := checksSchemas.Providers[provider.Provider].ResourceTypes[resourceType].ImpliedType()
+		change := &plans.ResourceInstanceChange{
+			Addr:         addrs.Resource{Mode: addrs.ManagedResourceMode, Type: resourceType, Name: "this"}.Instance(key).Absolute(module),
+			ProviderAddr: provider,
+			Change:       plans.Change{Action: plans.Create, Before: cty.NullVal(ty), After: after},
+		}
+		src, err := change.Encode(ty)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return src
+	}
+	bucket := func(name string, tags map[string]cty.Value) cty.Value {
+		if len(tags) == 0 {
+			return cty.ObjectVal(map[string]cty.Value{"bucket": cty.StringVal(name), "tags": cty.MapValEmpty(cty.String)})
+		}
+		return cty.ObjectVal(map[string]cty.Value{"bucket": cty.StringVal(name), "tags": cty.MapVal(tags)})
+	}
+	output := func(addr addrs.AbsOutputValue, val cty.Value) *plans.OutputChangeSrc {
+		change := &plans.OutputChange{Addr: addr, Change: plans.Change{Action: plans.Create, Before: cty.NullVal(cty.DynamicPseudoType), After: val}}
+		src, err := change.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return src
+	}
+
+	state := states.NewState()
+	state.RootModule().SetResourceInstanceCurrent(
+		addrs.Resource{Mode: addrs.DataResourceMode, Type: "aws_caller_identity", Name: "current"}.Instance(addrs.NoKey),
+		&states.ResourceInstanceObjectSrc{Status: states.ObjectReady, AttrsJSON: []byte(`{"account_id":"123456789012"}`)},
+		provider,
+	)
+
+	return &plans.Plan{
+		Changes: &plans.Changes{
+			Resources: []*plans.ResourceInstanceChangeSrc{
+				change("aws_s3_bucket", addrs.StringKey("logs"), addrs.RootModuleInstance, bucket("logs", map[string]cty.Value{"cost-center": cty.StringVal("ops")})),
+				change("aws_s3_bucket", addrs.StringKey("data"), addrs.RootModuleInstance, bucket("data", map[string]cty.Value{"env": cty.StringVal("prod")})),
+				change("aws_s3_bucket_public_access_block", addrs.StringKey("logs"), addrs.RootModuleInstance, cty.ObjectVal(map[string]cty.Value{"bucket": cty.StringVal("logs")})),
+				change("aws_s3_bucket", addrs.NoKey, addrs.RootModuleInstance.Child("storage", addrs.NoKey), bucket("child", map[string]cty.Value{})),
+			},
+			Outputs: []*plans.OutputChangeSrc{
+				output(addrs.OutputValue{Name: "region"}.Absolute(addrs.RootModuleInstance), cty.StringVal("eu-west-2")),
+				output(addrs.OutputValue{Name: "bucket_count"}.Absolute(addrs.RootModuleInstance.Child("storage", addrs.NoKey)), cty.NumberIntVal(1)),
+			},
+		},
+		State: state,
+	}
+}
+
+func TestValidateChecks(t *testing.T) {
+	spec, diags := ParseSpecWithOptions([]byte(`
+check "public_access_blocks" {
+  condition     = alltrue([for key, bucket in aws_s3_bucket.this : contains(keys(aws_s3_bucket_public_access_block.this), key)])
+  error_message = "Buckets without public access block : ${join(", ", [for key, bucket in aws_s3_bucket.this : key if !contains(keys(aws_s3_bucket_public_access_block.this), key)])}"
+}
+
+check "cost_center" {
+  condition = length([for bucket in values(aws_s3_bucket.this) : bucket if contains(keys(bucket.tags), "cost-center")]) > 0
+}
+
+check "account" {
+  condition = data.aws_caller_identity.current.account_id == var.account_id
+}
+
+check "outputs" {
+  condition = output.region == "eu-west-2" && module.storage.bucket_count == 1
+}
+
+check "not_a_boolean" {
+  condition = output.region
+}
+`), "test.tfspec", checksSchemas, &SpecOptions{Variables: map[string]cty.Value{"account_id": cty.StringVal("123456789012")}})
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if len(spec.Checks) != 5 {
+		t.Fatalf("Expected 5 checks. Got %d", len(spec.Checks))
+	}
+
+	result, err := spec.Validate(checksPlan(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		diag    tfdiags.Diagnostic
+		summary string
+	}{
+		{ErrorDiags(cty.GetAttrPath("check").GetAttr("public_access_blocks"), "condition is false"), "Buckets without public access block : data"},
+		{SuccessDiags(cty.GetAttrPath("check").GetAttr("cost_center"), "condition is true"), ""},
+		{SuccessDiags(cty.GetAttrPath("check").GetAttr("account"), "condition is true"), ""},
+		{SuccessDiags(cty.GetAttrPath("check").GetAttr("outputs"), "condition is true"), ""},
+		{ErrorDiags(cty.GetAttrPath("check").GetAttr("not_a_boolean"), `condition must be true or false : a bool is required`), ""},
+	}
+	if len(result) != len(expected) {
+		t.Fatalf("Expected %d diagnostics. Got %d : %v", len(expected), len(result), result)
+	}
+	for i := range result {
+		testDiagnostic(t, result[i], expected[i].diag)
+		if summary := result[i].Description().Summary; summary != expected[i].summary {
+			t.Errorf("Wrong summary. Got %q want %q", summary, expected[i].summary)
+		}
+	}
+}
+
+func TestCheckMissingCondition(t *testing.T) {
+	_, diags := ParseSpec([]byte(`
+check "empty" {
+  error_message = "no condition"
+}
+`), "test.tfspec", checksSchemas)
+	if !diags.HasErrors() {
+		t.Fatal("Parsing should fail")
+	}
+	if detail := diags[0].Detail; !strings.Contains(detail, `"condition" is required`) {
+		t.Errorf("Unexpected error : %s", detail)
+	}
+}
+
+func TestCheckUnknownAddress(t *testing.T) {
+	spec, diags := ParseSpec([]byte(`
+check "missing" {
+  condition = aws_instance.web.ami == "ami-123"
+}
+`), "test.tfspec", checksSchemas)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	result, err := spec.Validate(checksPlan(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.HasErrors() {
+		t.Fatal("Referencing a resource that isn't planned should fail")
+	}
+	if summary := result[0].Description().Summary; summary != "Unknown variable" {
+		t.Errorf("Unexpected error : %s", summary)
+	}
+}
@@ -3,16 +3,19 @@ package terraspec
 import (
 	"fmt"
 	"log"
+	"math/big"
 
 	"github.com/hashicorp/hcl/v2/hclsyntax"
 	"github.com/hashicorp/hcl/v2/hclwrite"
 	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
 )
 
 // PrimitiveValue will return the implied value if it's a primitive type
-// Number will be returned as int
+// Number will be returned as int when it's an integer, as a *big.Float otherwise to keep its precision
 // If a non primitive is given, nil will be returned
 func PrimitiveValue(val cty.Value) interface{} {
+	val, _ = val.Unmark()
 	if !val.IsKnown() || val.IsNull() {
 		return nil
 	}
@@ -20,8 +23,11 @@ func PrimitiveValue(val cty.Value) interface{} {
 	case cty.Bool:
 		return val.True()
 	case cty.Number:
-		v, _ := val.AsBigFloat().Int64()
-		return int(v)
+		f := val.AsBigFloat()
+		if v, accuracy := f.Int64(); accuracy == big.Exact && int64(int(v)) == v {
+			return int(v)
+		}
+		return f
 	case cty.String:
 		return val.AsString()
 	default:
@@ -33,6 +39,7 @@ func PrimitiveValue(val cty.Value) interface{} {
 
 // IsNull returns true if val is null or all its properties (recrusively) are null
 func IsNull(val cty.Value) bool {
+	val, _ = val.Unmark()
 	if val.IsNull() {
 		return true
 	}
@@ -54,14 +61,25 @@ func IsNull(val cty.Value) bool {
 
 // IsEmptyCollection returns true if value is a collection type of length 0
 func IsEmptyCollection(value cty.Value) bool {
+	value, _ = value.Unmark()
 	if value.Type().IsListType() || value.Type().IsSetType() {
 		return value.AsValueSet().Length() == 0
 	}
 	return false
 }
 
+// DisplayValue formats a value as it would be written in hcl
+func DisplayValue(value cty.Value) string {
+	value, _ = value.UnmarkDeep()
+	if !value.IsWhollyKnown() {
+		return "(known after apply)"
+	}
+	return string(hclwrite.TokensForValue(value).Bytes())
+}
+
 //MarshalValue serializes a cty.Value in hcl format
 func MarshalValue(value cty.Value) []byte {
+	value, _ = value.UnmarkDeep()
 	f := hclwrite.NewEmptyFile()
 	marshalValue(value, f.Body())
 	return f.Bytes()
@@ -152,3 +170,100 @@ func Merge(original, override cty.Value) cty.Value {
 	}
 	return cty.ObjectVal(merged)
 }
+
+// ConformValue converts value to the given type.
+// Unlike convert.Convert, object attributes missing in value are set to null instead of failing the conversion
+func ConformValue(value cty.Value, t cty.Type) (cty.Value, error) {
+	return conformValue(cty.Path{}, value, t)
+}
+
+func conformValue(path cty.Path, value cty.Value, t cty.Type) (cty.Value, error) {
+	// marks set by matchers are kept on the conformed value
+	value, marks := value.Unmark()
+	conformed, err := conformUnmarked(path, value, t)
+	if err != nil {
+		return cty.NilVal, err
+	}
+	return conformed.WithMarks(marks), nil
+}
+
+func conformUnmarked(path cty.Path, value cty.Value, t cty.Type) (cty.Value, error) {
+	if value.IsNull() {
+		return cty.NullVal(t), nil
+	}
+	if !value.IsKnown() {
+		return cty.UnknownVal(t), nil
+	}
+	vt := value.Type()
+	switch {
+	case t.IsObjectType() && (vt.IsObjectType() || vt.IsMapType()):
+		for it := value.ElementIterator(); it.Next(); {
+			k, _ := it.Element()
+			if !t.HasAttribute(k.AsString()) {
+				return cty.NilVal, path.NewErrorf("unsupported attribute %q", k.AsString())
+			}
+		}
+		vals := make(map[string]cty.Value, len(t.AttributeTypes()))
+		for name, at := range t.AttributeTypes() {
+			v := cty.NullVal(at)
+			if found := findAttribute(cty.StringVal(name), value); found.Type() != cty.NilType {
+				var err error
+				if v, err = conformValue(path.GetAttr(name), found, at); err != nil {
+					return cty.NilVal, err
+				}
+			}
+			vals[name] = v
+		}
+		return cty.ObjectVal(vals), nil
+	case (t.IsListType() || t.IsSetType()) && (vt.IsTupleType() || vt.IsListType() || vt.IsSetType()):
+		elems := make([]cty.Value, 0, value.LengthInt())
+		for it := value.ElementIterator(); it.Next(); {
+			k, v := it.Element()
+			e, err := conformValue(path.Index(k), v, t.ElementType())
+			if err != nil {
+				return cty.NilVal, err
+			}
+			elems = append(elems, e)
+		}
+		if t.ElementType().HasDynamicTypes() {
+			// elements may have different types, let convert unify them
+			return convertValue(path, cty.TupleVal(elems), t)
+		}
+		if t.IsListType() {
+			if len(elems) == 0 {
+				return cty.ListValEmpty(t.ElementType()), nil
+			}
+			return cty.ListVal(elems), nil
+		}
+		if len(elems) == 0 {
+			return cty.SetValEmpty(t.ElementType()), nil
+		}
+		return cty.SetVal(elems), nil
+	case t.IsMapType() && (vt.IsObjectType() || vt.IsMapType()):
+		elems := make(map[string]cty.Value, value.LengthInt())
+		for it := value.ElementIterator(); it.Next(); {
+			k, v := it.Element()
+			e, err := conformValue(path.Index(k), v, t.ElementType())
+			if err != nil {
+				return cty.NilVal, err
+			}
+			elems[k.AsString()] = e
+		}
+		if t.ElementType().HasDynamicTypes() {
+			return convertValue(path, cty.ObjectVal(elems), t)
+		}
+		if len(elems) == 0 {
+			return cty.MapValEmpty(t.ElementType()), nil
+		}
+		return cty.MapVal(elems), nil
+	}
+	return convertValue(path, value, t)
+}
+
+func convertValue(path cty.Path, value cty.Value, t cty.Type) (cty.Value, error) {
+	converted, err := convert.Convert(value, t)
+	if err != nil {
+		return cty.NilVal, path.NewError(err)
+	}
+	return converted, nil
+}
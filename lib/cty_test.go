@@ -1,6 +1,7 @@
 package terraspec_test
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 
@@ -53,6 +54,28 @@ func TestPrimitiveValue(t *testing.T) {
 	}
 }
 
+func TestPrimitiveValueNumbers(t *testing.T) {
+	big, _ := cty.ParseNumberVal("123456789012345678901234567890")
+	var tests = map[string]struct {
+		given    cty.Value
+		expected string
+	}{
+		"int":      {given: cty.NumberIntVal(-12), expected: "-12"},
+		"float":    {given: cty.NumberFloatVal(0.5), expected: "0.5"},
+		"decimal":  {given: cty.MustParseNumberVal("0.95"), expected: "0.95"},
+		"big":      {given: big, expected: "1.2345678901234567890123456789e+29"},
+		"negative": {given: cty.MustParseNumberVal("-0.001"), expected: "-0.001"},
+	}
+
+	for k, tt := range tests {
+		t.Run(k, func(t *testing.T) {
+			if got := fmt.Sprintf("%v", terraspec.PrimitiveValue(tt.given)); got != tt.expected {
+				t.Errorf("Error : Got %v - Want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
 func TestIsNull(t *testing.T) {
 	var tests = map[string]struct {
 		given    cty.Value
@@ -265,3 +288,81 @@ func TestMerge(t *testing.T) {
 		t.Errorf("Merge didn't returned expected value.\n Got %v\n Expected %v", got.GoString(), expected.GoString())
 	}
 }
+
+func TestConformValue(t *testing.T) {
+	objectType := cty.Object(map[string]cty.Type{
+		"name": cty.String,
+		"size": cty.Number,
+		"tags": cty.Map(cty.String),
+		"blocks": cty.List(cty.Object(map[string]cty.Type{
+			"key":   cty.String,
+			"value": cty.String,
+		})),
+	})
+
+	var tests = map[string]struct {
+		given       cty.Value
+		expected    cty.Value
+		expectError bool
+	}{
+		"partialObject": {
+			given: cty.ObjectVal(map[string]cty.Value{
+				"name": cty.StringVal("a"),
+				"tags": cty.ObjectVal(map[string]cty.Value{"env": cty.StringVal("dev")}),
+				"blocks": cty.TupleVal([]cty.Value{cty.ObjectVal(map[string]cty.Value{
+					"key": cty.StringVal("k"),
+				})}),
+			}),
+			expected: cty.ObjectVal(map[string]cty.Value{
+				"name": cty.StringVal("a"),
+				"size": cty.NullVal(cty.Number),
+				"tags": cty.MapVal(map[string]cty.Value{"env": cty.StringVal("dev")}),
+				"blocks": cty.ListVal([]cty.Value{cty.ObjectVal(map[string]cty.Value{
+					"key":   cty.StringVal("k"),
+					"value": cty.NullVal(cty.String),
+				})}),
+			}),
+		},
+		"convertedPrimitive": {
+			given: cty.ObjectVal(map[string]cty.Value{
+				"size": cty.StringVal("12"),
+			}),
+			expected: cty.ObjectVal(map[string]cty.Value{
+				"name":   cty.NullVal(cty.String),
+				"size":   cty.NumberIntVal(12),
+				"tags":   cty.NullVal(cty.Map(cty.String)),
+				"blocks": cty.NullVal(cty.List(cty.Object(map[string]cty.Type{"key": cty.String, "value": cty.String}))),
+			}),
+		},
+		"unsupportedAttribute": {
+			given: cty.ObjectVal(map[string]cty.Value{
+				"unknown": cty.StringVal("a"),
+			}),
+			expectError: true,
+		},
+		"wrongType": {
+			given: cty.ObjectVal(map[string]cty.Value{
+				"size": cty.StringVal("big"),
+			}),
+			expectError: true,
+		},
+	}
+
+	for k, tt := range tests {
+		t.Run(k, func(t *testing.T) {
+			got, err := terraspec.ConformValue(tt.given, objectType)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected an error. Got %v", got.GoString())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error : %v", err)
+			}
+			if !got.RawEquals(tt.expected) {
+				t.Errorf("ConformValue didn't return expected value.\n Got %v\n Expected %v", got.GoString(), tt.expected.GoString())
+			}
+		})
+	}
+}
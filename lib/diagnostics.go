@@ -27,11 +27,25 @@ func AssertErrorDiags(path cty.Path, expected, got interface{}) *TerraspecDiagno
 	return &TerraspecDiagnostic{tfdiags.AttributeValue(tfdiags.Error, "", fmt.Sprintf("%v != %v", got, expected), path)}
 }
 
+// UnknownErrorDiags returns a diagnostic at Error level to indicate the user the asserted value is only known after apply.
+// expected is omitted from the message when nil
+func UnknownErrorDiags(path cty.Path, expected interface{}) *TerraspecDiagnostic {
+	if expected == nil {
+		return ErrorDiags(path, "value is known after apply")
+	}
+	return ErrorDiags(path, fmt.Sprintf("value is known after apply, expected %v", expected))
+}
+
 // ErrorDiags returns a diagnostic at Error level with given error message
 func ErrorDiags(path cty.Path, detail string) *TerraspecDiagnostic {
 	return &TerraspecDiagnostic{tfdiags.AttributeValue(tfdiags.Error, "", detail, path)}
 }
 
+// WarningDiags returns a diagnostic at Warning level with given message
+func WarningDiags(path cty.Path, detail string) *TerraspecDiagnostic {
+	return &TerraspecDiagnostic{tfdiags.AttributeValue(tfdiags.Warning, "", detail, path)}
+}
+
 // RejectErrorDiags returns a diagnostic at Error level to indicate the user a given reject assertion failed
 func RejectErrorDiags(path cty.Path, rejected, got interface{}) *TerraspecDiagnostic {
 	return &TerraspecDiagnostic{tfdiags.AttributeValue(tfdiags.Error, "", fmt.Sprintf("%v matches %v", got, rejected), path)}
@@ -49,6 +63,22 @@ func RejectSuccessDiags(path cty.Path, message string, rejected interface{}) *Te
 	return &TerraspecDiagnostic{tfdiags.AttributeValue(Info, "", message, path)}
 }
 
+// withErrorMessage sets message as the summary of the error diagnostics that don't have one yet,
+// to explain the rule an assertion checks
+func withErrorMessage(diags tfdiags.Diagnostics, message string) tfdiags.Diagnostics {
+	if message == "" {
+		return diags
+	}
+	explained := make(tfdiags.Diagnostics, 0, len(diags))
+	for _, diag := range diags {
+		if d, ok := diag.(*TerraspecDiagnostic); ok && d.Severity() == tfdiags.Error && d.Description().Summary == "" {
+			diag = &TerraspecDiagnostic{tfdiags.AttributeValue(tfdiags.Error, message, d.Description().Detail, tfdiags.GetAttribute(d.Diagnostic))}
+		}
+		explained = append(explained, diag)
+	}
+	return explained
+}
+
 // Compare returns the difference in error numbers between one and other
 // if result == 0, then the 2 diagnostics have same number of errors
 // if result < 0, one has less error than other
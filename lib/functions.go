@@ -0,0 +1,23 @@
+package terraspec
+
+import (
+	"github.com/hashicorp/terraform/lang"
+	"github.com/zclconf/go-cty/cty/function"
+)
+
+// specFunctions returns the functions available in spec expressions : the ones terraform provides to configurations
+// and the matchers of terraspec. Functions reading files resolve relative paths from baseDir
+func specFunctions(baseDir string) map[string]function.Function {
+	scope := &lang.Scope{BaseDir: baseDir}
+	funcs := scope.Functions()
+	funcs["json_equal"] = jsonEqualFunc
+	funcs["unordered"] = unorderedFunc
+	funcs["contains_all"] = containsAllFunc
+	funcs["has_length"] = hasLengthFunc
+	funcs["unknown"] = unknownFunc
+	funcs["known"] = knownFunc
+	funcs["absent"] = absentFunc
+	funcs["approx"] = approxFunc
+	funcs["because"] = becauseFunc
+	return funcs
+}
@@ -0,0 +1,174 @@
+package terraspec
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclwrite"
+	"github.com/hashicorp/terraform/addrs"
+	"github.com/hashicorp/terraform/configs/configschema"
+	"github.com/hashicorp/terraform/plans"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// GenerateSpec builds the content of a starter .tfspec file from the given plan.
+// It writes an expect block for every planned resource and output and a mock stub
+// for every data source call that wasn't mocked. Outputs only known after apply are expected to be unknown(),
+// null and partially known outputs are only mentioned in a comment
+func GenerateSpec(plan *plans.Plan, schemas *terraform.Schemas, calls []*DataSourceCall) ([]byte, error) {
+	f := hclwrite.NewEmptyFile()
+	body := f.Body()
+
+	if plan.Changes != nil {
+		for _, resource := range plan.Changes.Resources {
+			if resource.Addr.Resource.Resource.Mode != addrs.ManagedResourceMode || resource.Action == plans.Delete {
+				continue
+			}
+			schema, _ := schemas.ResourceTypeConfig(resource.ProviderAddr.Provider, addrs.ManagedResourceMode, resource.Addr.Resource.Resource.Type)
+			if schema == nil {
+				return nil, fmt.Errorf("Could not find schema of resource %s", resource.Addr.String())
+			}
+			after, err := resource.After.Decode(schema.ImpliedType())
+			if err != nil {
+				return nil, fmt.Errorf("Error happened while decoding planned resource %s : %v", resource.Addr.String(), err)
+			}
+			aType, aName := resourceLabels(resource.Addr)
+			block := body.AppendNewBlock("expect", []string{aType, aName})
+			writeBlockValue(block.Body(), schema, after)
+			body.AppendNewline()
+		}
+
+		for _, output := range plan.Changes.Outputs {
+			if !output.Addr.Module.IsRoot() || output.Action == plans.Delete {
+				continue
+			}
+			change, err := output.Decode()
+			if err != nil {
+				return nil, fmt.Errorf("Error happened while decoding planned output %s : %v", output.Addr.OutputValue.Name, err)
+			}
+			name := output.Addr.OutputValue.Name
+			after, _ := change.After.UnmarkDeep()
+			switch {
+			case !after.IsKnown():
+				block := body.AppendNewBlock("expect", []string{"output", name})
+				block.Body().SetAttributeRaw("value", unknownCallTokens)
+			case after.IsNull():
+				appendComment(body, fmt.Sprintf("output %q is null", name))
+			case !after.IsWhollyKnown():
+				appendComment(body, fmt.Sprintf("output %q is partially known after apply", name))
+			default:
+				block := body.AppendNewBlock("expect", []string{"output", name})
+				block.Body().SetAttributeValue("value", after)
+			}
+			body.AppendNewline()
+		}
+	}
+
+	written := make([]*DataSourceCall, 0, len(calls))
+	for _, call := range calls {
+		if containsCall(written, call) {
+			continue
+		}
+		written = append(written, call)
+
+		provSchema, err := LookupProviderSchema(schemas, strings.Split(call.Type, "_")[0])
+		if err != nil {
+			return nil, err
+		}
+		schema, _ := provSchema.SchemaForResourceType(addrs.DataResourceMode, call.Type)
+		if schema == nil {
+			return nil, fmt.Errorf("Could not find schema of data source %s", call.Type)
+		}
+		block := body.AppendNewBlock("mock", []string{call.Type, fmt.Sprintf("mock_%d", len(written))})
+		writeBlockValue(block.Body(), schema, call.Config)
+		block.Body().AppendNewBlock("return", nil)
+		body.AppendNewline()
+	}
+
+	return f.Bytes(), nil
+}
+
+// unknownCallTokens are the tokens of a call to the unknown() matcher
+var unknownCallTokens = hclwrite.Tokens{
+	{Type: hclsyntax.TokenIdent, Bytes: []byte("unknown")},
+	{Type: hclsyntax.TokenOParen, Bytes: []byte("(")},
+	{Type: hclsyntax.TokenCParen, Bytes: []byte(")")},
+}
+
+// appendComment writes a single line comment in the given body
+func appendComment(body *hclwrite.Body, comment string) {
+	body.AppendUnstructuredTokens(hclwrite.Tokens{{Type: hclsyntax.TokenComment, Bytes: []byte("# " + comment + "\n")}})
+}
+
+// resourceLabels returns the type and name labels an assertion must have to target the given resource instance
+func resourceLabels(addr addrs.AbsResourceInstance) (string, string) {
+	aType := addr.Resource.Resource.Type
+	if !addr.Module.IsRoot() {
+		aType = fmt.Sprintf("%s.%s", addr.Module.String(), aType)
+	}
+	return aType, fmt.Sprintf("%s%s", addr.Resource.Resource.Name, addr.Resource.Key.String())
+}
+
+// writeBlockValue writes all configurable attributes and nested blocks of value in the given body.
+// Null and unknown values are skipped
+func writeBlockValue(body *hclwrite.Body, schema *configschema.Block, value cty.Value) {
+	if value.IsNull() || !value.IsKnown() {
+		return
+	}
+	attrNames := make([]string, 0, len(schema.Attributes))
+	for name := range schema.Attributes {
+		attrNames = append(attrNames, name)
+	}
+	sort.Strings(attrNames)
+	for _, name := range attrNames {
+		attr := schema.Attributes[name]
+		if !attr.Optional && !attr.Required {
+			continue
+		}
+		v := value.GetAttr(name)
+		if v.IsNull() || !v.IsWhollyKnown() {
+			continue
+		}
+		body.SetAttributeValue(name, v)
+	}
+	blockNames := make([]string, 0, len(schema.BlockTypes))
+	for name := range schema.BlockTypes {
+		blockNames = append(blockNames, name)
+	}
+	sort.Strings(blockNames)
+	for _, name := range blockNames {
+		nested := schema.BlockTypes[name]
+		v := value.GetAttr(name)
+		if v.IsNull() || !v.IsKnown() {
+			continue
+		}
+		switch nested.Nesting {
+		case configschema.NestingSingle, configschema.NestingGroup:
+			writeBlockValue(body.AppendNewBlock(name, nil).Body(), &nested.Block, v)
+		case configschema.NestingList, configschema.NestingSet:
+			it := v.ElementIterator()
+			for it.Next() {
+				_, elem := it.Element()
+				writeBlockValue(body.AppendNewBlock(name, nil).Body(), &nested.Block, elem)
+			}
+		case configschema.NestingMap:
+			it := v.ElementIterator()
+			for it.Next() {
+				key, elem := it.Element()
+				writeBlockValue(body.AppendNewBlock(name, []string{key.AsString()}).Body(), &nested.Block, elem)
+			}
+		}
+	}
+}
+
+func containsCall(calls []*DataSourceCall, call *DataSourceCall) bool {
+	for _, c := range calls {
+		if c.Type == call.Type && c.Config.RawEquals(call.Config) {
+			return true
+		}
+	}
+	return false
+}
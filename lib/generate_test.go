@@ -0,0 +1,167 @@
+package terraspec
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/addrs"
+	"github.com/hashicorp/terraform/configs/configschema"
+	"github.com/hashicorp/terraform/plans"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestGenerateSpec(t *testing.T) {
+	resourceSchema := &configschema.Block{
+		Attributes: map[string]*configschema.Attribute{
+			"property": {Type: cty.String, Optional: true},
+			"tags":     {Type: cty.Map(cty.String), Optional: true},
+			"id":       {Type: cty.String, Computed: true},
+		},
+		BlockTypes: map[string]*configschema.NestedBlock{
+			"inner": {
+				Block: configschema.Block{
+					Attributes: map[string]*configschema.Attribute{
+						"inner_prop": {Type: cty.String, Optional: true},
+					},
+				},
+				Nesting: configschema.NestingList,
+			},
+		},
+	}
+	dataSchema := &configschema.Block{
+		Attributes: map[string]*configschema.Attribute{
+			"query": {Type: cty.String, Optional: true},
+			"name":  {Type: cty.String, Computed: true},
+		},
+	}
+	provider := addrs.NewDefaultProvider("ressource")
+	schemas := &terraform.Schemas{
+		Providers: map[addrs.Provider]*terraform.ProviderSchema{
+			provider: {
+				ResourceTypes: map[string]*configschema.Block{"ressource_type": resourceSchema},
+				DataSources:   map[string]*configschema.Block{"ressource_data": dataSchema},
+			},
+		},
+	}
+
+	after := cty.ObjectVal(map[string]cty.Value{
+		"property": cty.StringVal("value"),
+		"tags":     cty.MapVal(map[string]cty.Value{"Name": cty.StringVal("test")}),
+		"id":       cty.UnknownVal(cty.String),
+		"inner": cty.ListVal([]cty.Value{cty.ObjectVal(map[string]cty.Value{
+			"inner_prop": cty.StringVal("value2"),
+		})}),
+	})
+	resourceChange := &plans.ResourceInstanceChange{
+		Addr: addrs.Resource{Mode: addrs.ManagedResourceMode, Type: "ressource_type", Name: "name"}.
+			Instance(addrs.IntKey(0)).Absolute(addrs.RootModuleInstance.Child("mod", addrs.NoKey)),
+		ProviderAddr: addrs.AbsProviderConfig{Module: addrs.RootModule, Provider: provider},
+		Change: plans.Change{
+			Action: plans.Create,
+			Before: cty.NullVal(after.Type()),
+			After:  after,
+		},
+	}
+	resourceSrc, err := resourceChange.Encode(resourceSchema.ImpliedType())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputChange := &plans.OutputChange{
+		Addr: addrs.OutputValue{Name: "out"}.Absolute(addrs.RootModuleInstance),
+		Change: plans.Change{
+			Action: plans.Create,
+			Before: cty.NullVal(cty.DynamicPseudoType),
+			After:  cty.StringVal("output_value"),
+		},
+	}
+	outputSrc, err := outputChange.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs := []*plans.OutputChangeSrc{outputSrc}
+	for _, output := range []struct {
+		name string
+		val  cty.Value
+	}{
+		{"empty", cty.NullVal(cty.String)},
+		{"id", cty.UnknownVal(cty.String)},
+		{"partial", cty.ObjectVal(map[string]cty.Value{"arn": cty.UnknownVal(cty.String)})},
+	} {
+		change := &plans.OutputChange{
+			Addr:   addrs.OutputValue{Name: output.name}.Absolute(addrs.RootModuleInstance),
+			Change: plans.Change{Action: plans.Create, Before: cty.NullVal(cty.DynamicPseudoType), After: output.val},
+		}
+		src, err := change.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, src)
+	}
+	plan := &plans.Plan{Changes: &plans.Changes{
+		Resources: []*plans.ResourceInstanceChangeSrc{resourceSrc},
+		Outputs:   outputs,
+	}}
+
+	call := &DataSourceCall{Type: "ressource_data", Config: cty.ObjectVal(map[string]cty.Value{
+		"query": cty.StringVal("q"),
+		"name":  cty.NullVal(cty.String),
+	})}
+
+	got, err := GenerateSpec(plan, schemas, []*DataSourceCall{call, call})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `expect "module.mod.ressource_type" "name[0]" {
+  property = "value"
+  tags = {
+    Name = "test"
+  }
+  inner {
+    inner_prop = "value2"
+  }
+}
+
+expect "output" "out" {
+  value = "output_value"
+}
+
+# output "empty" is null
+
+expect "output" "id" {
+  value = unknown()
+}
+
+# output "partial" is partially known after apply
+
+mock "ressource_data" "mock_1" {
+  query = "q"
+  return {
+  }
+}
+
+`
+	if string(got) != expected {
+		t.Errorf("Generated spec not as expected.\nGot:\n%s\nWant:\n%s", got, expected)
+	}
+
+	// the expectations on outputs must hold against the plan they were generated from
+	spec, diags := ParseSpec(got, "generated.tfspec", schemas)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	outputAsserts := make([]*Assert, 0)
+	for _, assert := range spec.Asserts {
+		if isOutput(assert.Type) {
+			outputAsserts = append(outputAsserts, assert)
+		}
+	}
+	spec.Asserts = outputAsserts
+	result, err := spec.Validate(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.HasErrors() {
+		t.Errorf("Generated expectations on outputs should pass. Got %v", result)
+	}
+}
@@ -0,0 +1,36 @@
+package terraspec
+
+import (
+	"github.com/hashicorp/terraform/addrs"
+	"github.com/hashicorp/terraform/plans"
+	"github.com/hashicorp/terraform/states"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// DataSourceHook is a terraform.Hook that tells the MockDataSourceReader which data source each call was made for.
+// Providers are never given the address of the data source they read, but terraform notifies hooks with the
+// address and the result of the read right after it happened
+type DataSourceHook struct {
+	terraform.NilHook
+	Reader *MockDataSourceReader
+}
+
+var _ terraform.Hook = (*DataSourceHook)(nil)
+
+// PostDiff is called once a data source has been read while computing the plan
+func (h *DataSourceHook) PostDiff(addr addrs.AbsResourceInstance, gen states.Generation, action plans.Action, priorState, plannedNewState cty.Value) (terraform.HookAction, error) {
+	// a deferred read doesn't call the provider
+	if addr.Resource.Resource.Mode == addrs.DataResourceMode && action != plans.Read {
+		h.Reader.SetCallAddress(addr, plannedNewState)
+	}
+	return terraform.HookActionContinue, nil
+}
+
+// PostApply is called once a data source has been read while applying the plan
+func (h *DataSourceHook) PostApply(addr addrs.AbsResourceInstance, gen states.Generation, newState cty.Value, err error) (terraform.HookAction, error) {
+	if addr.Resource.Resource.Mode == addrs.DataResourceMode && err == nil {
+		h.Reader.SetCallAddress(addr, newState)
+	}
+	return terraform.HookActionContinue, nil
+}
@@ -0,0 +1,394 @@
+package terraspec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/hashicorp/terraform/tfdiags"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// matcher is a cty mark set on an expected value to change how it's compared with the planned value
+type matcher string
+
+const (
+	// jsonMatcher compares JSON strings by their decoded structure
+	jsonMatcher matcher = "json_equal"
+	// unorderedMatcher compares the elements of a list whatever their order
+	unorderedMatcher matcher = "unordered"
+	// containsAllMatcher only checks the expected elements are found in the planned collection, whatever their order
+	containsAllMatcher matcher = "contains_all"
+	// strictMatcher requires planned lists to have exactly the expected elements
+	strictMatcher matcher = "strict"
+	// unknownMatcher requires the planned value to be known after apply only
+	unknownMatcher matcher = "unknown"
+	// knownMatcher requires the planned value to be known at plan time
+	knownMatcher matcher = "known"
+	// absentMatcher requires the planned value to be null or empty
+	absentMatcher matcher = "absent"
+)
+
+// withMatcher adds the matcher m to the marks of value.
+// Marks are removed first as marking an already marked value nests the marks in cty
+func withMatcher(value cty.Value, m matcher) cty.Value {
+	value, marks := value.Unmark()
+	return value.WithMarks(marks, cty.NewValueMarks(m))
+}
+
+// toleranceMatcher is a cty mark allowing the planned number to differ from the expected one by the given tolerance
+type toleranceMatcher string
+
+// toleranceOf returns the tolerance given by the marks, if any
+func toleranceOf(marks cty.ValueMarks) (*big.Float, bool) {
+	for mark := range marks {
+		if t, ok := mark.(toleranceMatcher); ok {
+			tolerance, _, err := big.ParseFloat(string(t), 10, 512, big.ToNearestEven)
+			return tolerance, err == nil
+		}
+	}
+	return nil, false
+}
+
+// lengthMatcher is a cty mark checking the number of elements of the planned collection
+type lengthMatcher int
+
+// lengthOf returns the length expected by the marks, if any
+func lengthOf(marks cty.ValueMarks) (int, bool) {
+	for mark := range marks {
+		if l, ok := mark.(lengthMatcher); ok {
+			return int(l), true
+		}
+	}
+	return 0, false
+}
+
+// hasMatcher indicates if the given marks contain the matcher m
+func hasMatcher(marks cty.ValueMarks, m matcher) bool {
+	_, ok := marks[m]
+	return ok
+}
+
+// jsonEqualFunc marks a JSON string so that it's compared semantically with the planned value.
+// A value that isn't a string is encoded in JSON first
+var jsonEqualFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "json", Type: cty.DynamicPseudoType},
+	},
+	Type: function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		val := args[0]
+		if val.Type() == cty.String {
+			if _, err := decodeJSON(val.AsString()); err != nil {
+				return cty.UnknownVal(cty.String), function.NewArgErrorf(0, "invalid JSON : %v", err)
+			}
+			return val.Mark(jsonMatcher), nil
+		}
+		encoded, err := ctyjson.Marshal(val, val.Type())
+		if err != nil {
+			return cty.UnknownVal(cty.String), function.NewArgError(0, err)
+		}
+		return cty.StringVal(string(encoded)).Mark(jsonMatcher), nil
+	},
+})
+
+// unorderedFunc marks a list so that its elements are matched with the planned ones whatever their order
+var unorderedFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "list", Type: cty.DynamicPseudoType},
+	},
+	Type: func(args []cty.Value) (cty.Type, error) {
+		t := args[0].Type()
+		if !t.IsListType() && !t.IsSetType() && !t.IsTupleType() && t != cty.DynamicPseudoType {
+			return cty.NilType, function.NewArgErrorf(0, "unordered only applies to lists, got %s", t.FriendlyName())
+		}
+		return t, nil
+	},
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		return args[0].Mark(unorderedMatcher), nil
+	},
+})
+
+// containsAllFunc marks a list so that the planned collection only has to contain all its elements, in any order
+var containsAllFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "list", Type: cty.DynamicPseudoType},
+	},
+	Type: func(args []cty.Value) (cty.Type, error) {
+		t := args[0].Type()
+		if !t.IsListType() && !t.IsSetType() && !t.IsTupleType() && t != cty.DynamicPseudoType {
+			return cty.NilType, function.NewArgErrorf(0, "contains_all only applies to lists, got %s", t.FriendlyName())
+		}
+		return t, nil
+	},
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		return args[0].Mark(containsAllMatcher), nil
+	},
+})
+
+// hasLengthFunc returns a placeholder checking the planned collection has the given number of elements
+var hasLengthFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "length", Type: cty.Number},
+	},
+	Type: function.StaticReturnType(cty.DynamicPseudoType),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		length, accuracy := args[0].AsBigFloat().Int64()
+		if accuracy != big.Exact || length < 0 {
+			return cty.DynamicVal, function.NewArgErrorf(0, "length must be a positive integer")
+		}
+		return cty.DynamicVal.Mark(lengthMatcher(length)), nil
+	},
+})
+
+// unknownFunc returns a placeholder checking the planned value is only known after apply
+var unknownFunc = function.New(&function.Spec{
+	Type: function.StaticReturnType(cty.DynamicPseudoType),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		return cty.DynamicVal.Mark(unknownMatcher), nil
+	},
+})
+
+// knownFunc returns a placeholder checking the planned value is known at plan time, whatever its value
+var knownFunc = function.New(&function.Spec{
+	Type: function.StaticReturnType(cty.DynamicPseudoType),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		return cty.DynamicVal.Mark(knownMatcher), nil
+	},
+})
+
+// checkKnown checks the planned value is known at plan time if known is set, or only known after apply otherwise
+func checkKnown(path cty.Path, known bool, got cty.Value) tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+	switch {
+	case known && !got.IsWhollyKnown():
+		return diags.Append(UnknownErrorDiags(path, nil))
+	case known:
+		return diags.Append(SuccessDiags(path, DisplayValue(got)))
+	case got.IsKnown():
+		return diags.Append(ErrorDiags(path, fmt.Sprintf("value is known at plan time : %s", DisplayValue(got))))
+	default:
+		return diags.Append(SuccessDiags(path, "value is known after apply"))
+	}
+}
+
+// absentFunc returns a placeholder checking the planned value is null or empty
+var absentFunc = function.New(&function.Spec{
+	Type: function.StaticReturnType(cty.DynamicPseudoType),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		return cty.NullVal(cty.DynamicPseudoType).Mark(absentMatcher), nil
+	},
+})
+
+// checkAbsent checks the planned value is null or an empty collection
+func checkAbsent(path cty.Path, got cty.Value) tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+	if got.IsNull() || (got.IsKnown() && IsEmptyCollection(got)) {
+		return diags.Append(SuccessDiags(path, "value is absent"))
+	}
+	if !got.IsKnown() {
+		return diags.Append(UnknownErrorDiags(path, "no value"))
+	}
+	return diags.Append(ErrorDiags(path, fmt.Sprintf("Unexpected value %s, expected no value", DisplayValue(got))))
+}
+
+// reason is a cty mark explaining why a value is expected, set as the summary of the failed assertions on it
+type reason string
+
+// reasonOf returns the reason given by the marks, if any
+func reasonOf(marks cty.ValueMarks) string {
+	for mark := range marks {
+		if r, ok := mark.(reason); ok {
+			return string(r)
+		}
+	}
+	return ""
+}
+
+// becauseFunc marks an expected value with the reason reported when it doesn't match the planned value
+var becauseFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "value", Type: cty.DynamicPseudoType, AllowNull: true, AllowUnknown: true, AllowDynamicType: true, AllowMarked: true},
+		{Name: "message", Type: cty.String},
+	},
+	Type: func(args []cty.Value) (cty.Type, error) {
+		return args[0].Type(), nil
+	},
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		value, marks := args[0].Unmark()
+		return value.WithMarks(marks, cty.NewValueMarks(reason(args[1].AsString()))), nil
+	},
+})
+
+// approxFunc marks a number so that the planned number can differ from it by the given tolerance
+var approxFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "number", Type: cty.Number},
+		{Name: "tolerance", Type: cty.Number},
+	},
+	Type: function.StaticReturnType(cty.Number),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		tolerance := args[1].AsBigFloat()
+		if tolerance.Sign() < 0 {
+			return cty.UnknownVal(cty.Number), function.NewArgErrorf(1, "tolerance must not be negative")
+		}
+		return args[0].Mark(toleranceMatcher(tolerance.Text('g', -1))), nil
+	},
+})
+
+// checkApprox checks the planned number differs from the expected one by tolerance at most
+func checkApprox(path cty.Path, expected cty.Value, tolerance *big.Float, got cty.Value) tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+	if got.IsNull() || got.Type() != cty.Number {
+		return diags.Append(AssertErrorDiags(path, fmt.Sprintf("%v ± %v", PrimitiveValue(expected), tolerance), PrimitiveValue(got)))
+	}
+	diff := new(big.Float).Sub(expected.AsBigFloat(), got.AsBigFloat())
+	if diff.Abs(diff).Cmp(tolerance) > 0 {
+		return diags.Append(AssertErrorDiags(path, fmt.Sprintf("%v ± %v", PrimitiveValue(expected), tolerance), PrimitiveValue(got)))
+	}
+	return diags.Append(SuccessDiags(path, PrimitiveValue(got)))
+}
+
+// checkLength checks the planned collection has the expected number of elements
+func checkLength(path cty.Path, expected int, got cty.Value) tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+	length := 0
+	if !got.IsNull() {
+		if !got.Type().IsListType() && !got.Type().IsSetType() && !got.Type().IsTupleType() && !got.Type().IsMapType() {
+			return diags.Append(ErrorDiags(path, "Element is not a collection"))
+		}
+		length = got.LengthInt()
+	}
+	if length != expected {
+		return diags.Append(ErrorDiags(path, fmt.Sprintf("Collection has %d element(s), expected %d", length, expected)))
+	}
+	return diags.Append(SuccessDiags(path, fmt.Sprintf("%d element(s)", length)))
+}
+
+// unexpectedElementDiags reports an element of the planned collection that isn't in the spec
+func unexpectedElementDiags(path cty.Path, index int, value cty.Value) tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+	return diags.Append(ErrorDiags(path.Index(cty.NumberIntVal(int64(index))), fmt.Sprintf("Unexpected element at index %d : %s", index, DisplayValue(value))))
+}
+
+// isJSON indicates if the given string is a JSON object or array
+func isJSON(s string) bool {
+	trimmed := bytes.TrimSpace([]byte(s))
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return false
+	}
+	_, err := decodeJSON(s)
+	return err == nil
+}
+
+func decodeJSON(s string) (interface{}, error) {
+	var decoded interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(s)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
+
+// checkJSON compares the JSON documents held by expected and got strings.
+// Every difference is reported at its path in the JSON document
+func checkJSON(path cty.Path, expected, got cty.Value) tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+	if got.IsNull() || got.Type() != cty.String {
+		return diags.Append(AssertErrorDiags(path, PrimitiveValue(expected), PrimitiveValue(got)))
+	}
+	exp, err := decodeJSON(expected.AsString())
+	if err != nil {
+		return diags.Append(ErrorDiags(path, fmt.Sprintf("Expected value is not valid JSON : %v", err)))
+	}
+	g, err := decodeJSON(got.AsString())
+	if err != nil {
+		return diags.Append(ErrorDiags(path, fmt.Sprintf("Value is not valid JSON : %v", err)))
+	}
+	diags = diags.Append(compareJSON(path, exp, g))
+	if !diags.HasErrors() {
+		diags = diags.Append(SuccessDiags(path, "JSON documents are equal"))
+	}
+	return diags
+}
+
+func compareJSON(path cty.Path, expected, got interface{}) tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+	switch exp := expected.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			return diags.Append(AssertErrorDiags(path, encodeJSON(expected), encodeJSON(got)))
+		}
+		keys := make([]string, 0, len(exp)+len(g))
+		for k := range exp {
+			keys = append(keys, k)
+		}
+		for k := range g {
+			if _, ok := exp[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			e, inExpected := exp[k]
+			v, inGot := g[k]
+			switch {
+			case !inGot:
+				diags = diags.Append(ErrorDiags(path.GetAttr(k), fmt.Sprintf("Missing value %s", encodeJSON(e))))
+			case !inExpected:
+				diags = diags.Append(ErrorDiags(path.GetAttr(k), fmt.Sprintf("Unexpected value %s", encodeJSON(v))))
+			default:
+				diags = diags.Append(compareJSON(path.GetAttr(k), e, v))
+			}
+		}
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok {
+			return diags.Append(AssertErrorDiags(path, encodeJSON(expected), encodeJSON(got)))
+		}
+		for i := 0; i < len(exp) || i < len(g); i++ {
+			p := path.Index(cty.NumberIntVal(int64(i)))
+			switch {
+			case i >= len(g):
+				diags = diags.Append(ErrorDiags(p, fmt.Sprintf("Missing value %s", encodeJSON(exp[i]))))
+			case i >= len(exp):
+				diags = diags.Append(ErrorDiags(p, fmt.Sprintf("Unexpected value %s", encodeJSON(g[i]))))
+			default:
+				diags = diags.Append(compareJSON(p, exp[i], g[i]))
+			}
+		}
+	case json.Number:
+		g, ok := got.(json.Number)
+		if !ok || !equalNumbers(exp, g) {
+			diags = diags.Append(AssertErrorDiags(path, encodeJSON(expected), encodeJSON(got)))
+		}
+	default:
+		if expected != got {
+			diags = diags.Append(AssertErrorDiags(path, encodeJSON(expected), encodeJSON(got)))
+		}
+	}
+	return diags
+}
+
+func equalNumbers(a, b json.Number) bool {
+	fa, _, errA := big.ParseFloat(a.String(), 10, 512, big.ToNearestEven)
+	fb, _, errB := big.ParseFloat(b.String(), 10, 512, big.ToNearestEven)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return fa.Cmp(fb) == 0
+}
+
+func encodeJSON(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(encoded)
+}
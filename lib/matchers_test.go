@@ -0,0 +1,420 @@
+package terraspec
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/tfdiags"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"github.com/zclconf/go-cty/cty/function"
+)
+
+func TestCheckJSON(t *testing.T) {
+	policy := `{
+  "Version": "2012-10-17",
+  "Statement": [
+    {"Effect": "Allow", "Action": ["s3:GetObject"], "Resource": "*"}
+  ]
+}`
+	path := cty.GetAttrPath("aws_iam_policy.policy").GetAttr("policy")
+	statement := path.GetAttr("Statement").Index(cty.NumberIntVal(0))
+
+	jsonEqual := func(v cty.Value) cty.Value {
+		marked, err := jsonEqualFunc.Call([]cty.Value{v})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return marked
+	}
+
+	tests := map[string]struct {
+		expected cty.Value
+		got      cty.Value
+		diags    tfdiags.Diagnostics
+	}{
+		"auto detected": {
+			expected: cty.StringVal(policy),
+			got:      cty.StringVal(`{"Statement":[{"Action":["s3:GetObject"],"Effect":"Allow","Resource":"*"}],"Version":"2012-10-17"}`),
+			diags:    tfdiags.Diagnostics{SuccessDiags(path, "JSON documents are equal")},
+		},
+		"differences": {
+			expected: cty.StringVal(policy),
+			got:      cty.StringVal(`{"Statement":[{"Action":["s3:GetObject","s3:PutObject"],"Effect":"Deny"}],"Version":"2012-10-17"}`),
+			diags: tfdiags.Diagnostics{
+				ErrorDiags(statement.GetAttr("Action").Index(cty.NumberIntVal(1)), `Unexpected value "s3:PutObject"`),
+				AssertErrorDiags(statement.GetAttr("Effect"), `"Allow"`, `"Deny"`),
+				ErrorDiags(statement.GetAttr("Resource"), `Missing value "*"`),
+			},
+		},
+		"json_equal with object": {
+			expected: jsonEqual(cty.ObjectVal(map[string]cty.Value{"count": cty.NumberIntVal(1)})),
+			got:      cty.StringVal(`{ "count": 1.0 }`),
+			diags:    tfdiags.Diagnostics{SuccessDiags(path, "JSON documents are equal")},
+		},
+		"json_equal with invalid value": {
+			expected: jsonEqual(cty.StringVal(`"text"`)),
+			got:      cty.StringVal(`text`),
+			diags:    tfdiags.Diagnostics{ErrorDiags(path, "Value is not valid JSON : invalid character 'e' in literal true (expecting 'r')")},
+		},
+		"plain strings": {
+			expected: cty.StringVal("{not json"),
+			got:      cty.StringVal("{not json either"),
+			diags:    tfdiags.Diagnostics{AssertErrorDiags(path, "{not json", "{not json either")},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := checkAssert(path, tt.expected, tt.got)
+			if len(got) != len(tt.diags) {
+				t.Fatalf("Expected %d diagnostics. Got %d : %v", len(tt.diags), len(got), got)
+			}
+			for i := range got {
+				testDiagnostic(t, got[i], tt.diags[i])
+			}
+		})
+	}
+}
+
+func TestJSONEqualRejectsInvalidJSON(t *testing.T) {
+	if _, err := jsonEqualFunc.Call([]cty.Value{cty.StringVal("{")}); err == nil {
+		t.Errorf("json_equal should fail with invalid JSON")
+	}
+}
+
+func TestCheckAssertUnordered(t *testing.T) {
+	path := cty.GetAttrPath("test")
+	unordered := func(v cty.Value) cty.Value {
+		marked, err := unorderedFunc.Call([]cty.Value{v})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return marked
+	}
+	rule := func(port int64, cidr string) cty.Value {
+		return cty.ObjectVal(map[string]cty.Value{"port": cty.NumberIntVal(port), "cidr": cty.StringVal(cidr)})
+	}
+	got := cty.ListVal([]cty.Value{cty.StringVal("b"), cty.StringVal("a")})
+
+	tests := map[string]struct {
+		expected cty.Value
+		got      cty.Value
+		diags    tfdiags.Diagnostics
+	}{
+		"set": {
+			expected: cty.SetVal([]cty.Value{rule(443, "10.0.0.0/8"), rule(80, "0.0.0.0/0")}),
+			got:      cty.SetVal([]cty.Value{rule(80, "0.0.0.0/0"), rule(22, "10.0.0.0/8"), rule(443, "10.0.0.0/8")}),
+			diags: tfdiags.Diagnostics{
+				SuccessDiags(path.Index(cty.NumberIntVal(0)).GetAttr("cidr"), "0.0.0.0/0"),
+				SuccessDiags(path.Index(cty.NumberIntVal(0)).GetAttr("port"), 80),
+				SuccessDiags(path.Index(cty.NumberIntVal(1)).GetAttr("cidr"), "10.0.0.0/8"),
+				SuccessDiags(path.Index(cty.NumberIntVal(1)).GetAttr("port"), 443),
+			},
+		},
+		"ordered list": {
+			expected: cty.ListVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b")}),
+			got:      got,
+			diags: tfdiags.Diagnostics{
+				AssertErrorDiags(path.Index(cty.NumberIntVal(0)), "a", "b"),
+				AssertErrorDiags(path.Index(cty.NumberIntVal(1)), "b", "a"),
+			},
+		},
+		"unordered list": {
+			expected: unordered(cty.TupleVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b")})),
+			got:      got,
+			diags: tfdiags.Diagnostics{
+				SuccessDiags(path.Index(cty.NumberIntVal(0)), "a"),
+				SuccessDiags(path.Index(cty.NumberIntVal(1)), "b"),
+			},
+		},
+		"element matched once": {
+			expected: unordered(cty.ListVal([]cty.Value{cty.StringVal("a"), cty.StringVal("a")})),
+			got:      got,
+			diags: tfdiags.Diagnostics{
+				SuccessDiags(path.Index(cty.NumberIntVal(0)), "a"),
+				AssertErrorDiags(path.Index(cty.NumberIntVal(1)), "a", "b"),
+			},
+		},
+		"less specific element first": {
+			expected: unordered(cty.TupleVal([]cty.Value{
+				cty.ObjectVal(map[string]cty.Value{"name": cty.StringVal("x")}),
+				cty.ObjectVal(map[string]cty.Value{"name": cty.StringVal("x"), "port": cty.NumberIntVal(80)}),
+			})),
+			got: cty.ListVal([]cty.Value{
+				cty.ObjectVal(map[string]cty.Value{"name": cty.StringVal("x"), "port": cty.NumberIntVal(80)}),
+				cty.ObjectVal(map[string]cty.Value{"name": cty.StringVal("x"), "port": cty.NumberIntVal(443)}),
+			}),
+			diags: tfdiags.Diagnostics{
+				SuccessDiags(path.Index(cty.NumberIntVal(0)).GetAttr("name"), "x"),
+				SuccessDiags(path.Index(cty.NumberIntVal(1)).GetAttr("name"), "x"),
+				SuccessDiags(path.Index(cty.NumberIntVal(1)).GetAttr("port"), 80),
+			},
+		},
+		"missing element": {
+			expected: unordered(cty.ListVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b"), cty.StringVal("c")})),
+			got:      got,
+			diags: tfdiags.Diagnostics{
+				SuccessDiags(path.Index(cty.NumberIntVal(0)), "a"),
+				SuccessDiags(path.Index(cty.NumberIntVal(1)), "b"),
+				ErrorDiags(path.Index(cty.NumberIntVal(2)), "Could not find any element matching child at index 2"),
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := checkAssert(path, tt.expected, tt.got)
+			if len(got) != len(tt.diags) {
+				t.Fatalf("Expected %d diagnostics. Got %d : %v", len(tt.diags), len(got), got)
+			}
+			for i := range got {
+				testDiagnostic(t, got[i], tt.diags[i])
+			}
+		})
+	}
+}
+
+func TestCheckAssertStrict(t *testing.T) {
+	path := cty.GetAttrPath("test")
+	call := func(f function.Function, v cty.Value) cty.Value {
+		marked, err := f.Call([]cty.Value{v})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return marked
+	}
+	strict := func(v cty.Value) cty.Value {
+		return withMatcher(v, strictMatcher)
+	}
+	hasLength := func(n int64, ty cty.Type) cty.Value {
+		v, err := convert.Convert(call(hasLengthFunc, cty.NumberIntVal(n)), ty)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	got := cty.ListVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b"), cty.StringVal("c")})
+
+	tests := map[string]struct {
+		expected cty.Value
+		diags    tfdiags.Diagnostics
+	}{
+		"prefix": {
+			expected: cty.ListVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b")}),
+			diags: tfdiags.Diagnostics{
+				SuccessDiags(path.Index(cty.NumberIntVal(0)), "a"),
+				SuccessDiags(path.Index(cty.NumberIntVal(1)), "b"),
+			},
+		},
+		"strict list": {
+			expected: strict(cty.ListVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b")})),
+			diags: tfdiags.Diagnostics{
+				SuccessDiags(path.Index(cty.NumberIntVal(0)), "a"),
+				SuccessDiags(path.Index(cty.NumberIntVal(1)), "b"),
+				ErrorDiags(path.Index(cty.NumberIntVal(2)), `Unexpected element at index 2 : "c"`),
+			},
+		},
+		"strict nested list": {
+			expected: strict(cty.ObjectVal(map[string]cty.Value{"list": cty.ListVal([]cty.Value{cty.StringVal("a")})})),
+			diags: tfdiags.Diagnostics{
+				SuccessDiags(path.GetAttr("list").Index(cty.NumberIntVal(0)), "a"),
+				ErrorDiags(path.GetAttr("list").Index(cty.NumberIntVal(1)), `Unexpected element at index 1 : "b"`),
+				ErrorDiags(path.GetAttr("list").Index(cty.NumberIntVal(2)), `Unexpected element at index 2 : "c"`),
+			},
+		},
+		"strict unordered": {
+			expected: strict(call(unorderedFunc, cty.ListVal([]cty.Value{cty.StringVal("c"), cty.StringVal("a")}))),
+			diags: tfdiags.Diagnostics{
+				SuccessDiags(path.Index(cty.NumberIntVal(0)), "c"),
+				SuccessDiags(path.Index(cty.NumberIntVal(1)), "a"),
+				ErrorDiags(path.Index(cty.NumberIntVal(1)), `Unexpected element at index 1 : "b"`),
+			},
+		},
+		"contains_all": {
+			expected: strict(call(containsAllFunc, cty.ListVal([]cty.Value{cty.StringVal("c"), cty.StringVal("a")}))),
+			diags: tfdiags.Diagnostics{
+				SuccessDiags(path.Index(cty.NumberIntVal(0)), "c"),
+				SuccessDiags(path.Index(cty.NumberIntVal(1)), "a"),
+			},
+		},
+		"has_length": {
+			expected: hasLength(3, cty.List(cty.String)),
+			diags: tfdiags.Diagnostics{
+				SuccessDiags(path, "3 element(s)"),
+			},
+		},
+		"wrong length": {
+			expected: strict(cty.ObjectVal(map[string]cty.Value{"list": hasLength(2, cty.List(cty.String))})),
+			diags: tfdiags.Diagnostics{
+				ErrorDiags(path.GetAttr("list"), "Collection has 3 element(s), expected 2"),
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			value := got
+			if tt.expected.Type().IsObjectType() {
+				value = cty.ObjectVal(map[string]cty.Value{"list": got})
+			}
+			diags := checkAssert(path, tt.expected, value)
+			if len(diags) != len(tt.diags) {
+				t.Fatalf("Expected %d diagnostics. Got %d : %v", len(tt.diags), len(diags), diags)
+			}
+			for i := range diags {
+				testDiagnostic(t, diags[i], tt.diags[i])
+			}
+		})
+	}
+}
+
+func TestCheckAssertKnown(t *testing.T) {
+	path := cty.GetAttrPath("test")
+	call := func(f function.Function) cty.Value {
+		marked, err := f.Call(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return marked
+	}
+
+	tests := map[string]struct {
+		expected cty.Value
+		got      cty.Value
+		diags    tfdiags.Diagnostics
+	}{
+		"unknown": {
+			expected: call(unknownFunc),
+			got:      cty.UnknownVal(cty.String),
+			diags:    tfdiags.Diagnostics{SuccessDiags(path, "value is known after apply")},
+		},
+		"unknown but known": {
+			expected: call(unknownFunc),
+			got:      cty.StringVal("i-1234"),
+			diags:    tfdiags.Diagnostics{ErrorDiags(path, `value is known at plan time : "i-1234"`)},
+		},
+		"known": {
+			expected: call(knownFunc),
+			got:      cty.StringVal("i-1234"),
+			diags:    tfdiags.Diagnostics{SuccessDiags(path, `"i-1234"`)},
+		},
+		"known but unknown": {
+			expected: call(knownFunc),
+			got:      cty.ListVal([]cty.Value{cty.UnknownVal(cty.String)}),
+			diags:    tfdiags.Diagnostics{ErrorDiags(path, "value is known after apply")},
+		},
+		"value known after apply": {
+			expected: cty.StringVal("i-1234"),
+			got:      cty.UnknownVal(cty.String),
+			diags:    tfdiags.Diagnostics{ErrorDiags(path, "value is known after apply, expected i-1234")},
+		},
+		"object known after apply": {
+			expected: cty.ObjectVal(map[string]cty.Value{"id": cty.StringVal("i-1234")}),
+			got:      cty.UnknownVal(cty.Object(map[string]cty.Type{"id": cty.String})),
+			diags:    tfdiags.Diagnostics{ErrorDiags(path, "value is known after apply")},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			diags := checkAssert(path, tt.expected, tt.got)
+			if len(diags) != len(tt.diags) {
+				t.Fatalf("Expected %d diagnostics. Got %d : %v", len(tt.diags), len(diags), diags)
+			}
+			for i := range diags {
+				testDiagnostic(t, diags[i], tt.diags[i])
+			}
+		})
+	}
+}
+
+func TestCheckAssertApprox(t *testing.T) {
+	path := cty.GetAttrPath("test")
+	approx := func(v, tolerance cty.Value) cty.Value {
+		marked, err := approxFunc.Call([]cty.Value{v, tolerance})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return marked
+	}
+
+	tests := map[string]struct {
+		expected cty.Value
+		got      cty.Value
+		diags    tfdiags.Diagnostics
+	}{
+		"within tolerance": {
+			expected: approx(cty.MustParseNumberVal("0.95"), cty.MustParseNumberVal("0.01")),
+			got:      cty.MustParseNumberVal("0.9432"),
+			diags:    tfdiags.Diagnostics{SuccessDiags(path, "0.9432")},
+		},
+		"out of tolerance": {
+			expected: approx(cty.MustParseNumberVal("0.95"), cty.MustParseNumberVal("0.01")),
+			got:      cty.MustParseNumberVal("0.9"),
+			diags:    tfdiags.Diagnostics{AssertErrorDiags(path, "0.95 ± 0.01", "0.9")},
+		},
+		"float without tolerance": {
+			expected: cty.MustParseNumberVal("0.5"),
+			got:      cty.NumberIntVal(0),
+			diags:    tfdiags.Diagnostics{AssertErrorDiags(path, "0.5", "0")},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			diags := checkAssert(path, tt.expected, tt.got)
+			if len(diags) != len(tt.diags) {
+				t.Fatalf("Expected %d diagnostics. Got %d : %v", len(tt.diags), len(diags), diags)
+			}
+			for i := range diags {
+				testDiagnostic(t, diags[i], tt.diags[i])
+			}
+		})
+	}
+}
+
+func TestApproxRejectsNegativeTolerance(t *testing.T) {
+	if _, err := approxFunc.Call([]cty.Value{cty.NumberIntVal(1), cty.NumberIntVal(-1)}); err == nil {
+		t.Errorf("approx should fail with a negative tolerance")
+	}
+}
+
+func TestCheckAssertBecause(t *testing.T) {
+	because := func(v cty.Value, message string) cty.Value {
+		marked, err := becauseFunc.Call([]cty.Value{v, cty.StringVal(message)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return marked
+	}
+	expected := because(cty.ObjectVal(map[string]cty.Value{
+		"name":    cty.StringVal("logs"),
+		"kms_key": because(cty.StringVal("alias/storage"), "Buckets are encrypted with our KMS key"),
+		"tags":    because(cty.DynamicVal.Mark(lengthMatcher(2)), "Buckets have two tags"),
+	}), "Buckets follow the storage policy")
+	got := cty.ObjectVal(map[string]cty.Value{
+		"name":    cty.StringVal("data"),
+		"kms_key": cty.StringVal("alias/default"),
+		"tags":    cty.MapVal(map[string]cty.Value{"env": cty.StringVal("prod")}),
+	})
+
+	summaries := map[string]string{
+		"kms_key": "Buckets are encrypted with our KMS key",
+		"name":    "Buckets follow the storage policy",
+		"tags":    "Buckets have two tags",
+	}
+	diags := checkAssert(cty.Path{}, expected, got)
+	if len(diags) != len(summaries) {
+		t.Fatalf("Expected %d diagnostics. Got %d : %v", len(summaries), len(diags), diags)
+	}
+	for _, diag := range diags {
+		if diag.Severity() != tfdiags.Error {
+			t.Errorf("Expected an error. Got %s", diag.Description().Detail)
+			continue
+		}
+		name := tfdiags.GetAttribute(diag.(*TerraspecDiagnostic).Diagnostic)[0].(cty.GetAttrStep).Name
+		if summary := diag.Description().Summary; summary != summaries[name] {
+			t.Errorf("Wrong summary for %s. Got %q want %q", name, summary, summaries[name])
+		}
+	}
+}
@@ -16,10 +16,13 @@ import (
 	svchost "github.com/hashicorp/terraform-svchost"
 	"github.com/hashicorp/terraform/addrs"
 	terraformProvider "github.com/hashicorp/terraform/builtin/providers/terraform"
+	"github.com/hashicorp/terraform/configs"
 	"github.com/hashicorp/terraform/helper/logging"
+	"github.com/hashicorp/terraform/plans"
 	"github.com/hashicorp/terraform/plugin"
 	"github.com/hashicorp/terraform/plugin/discovery"
 	"github.com/hashicorp/terraform/providers"
+	"github.com/hashicorp/terraform/terraform"
 	"github.com/hashicorp/terraform/tfdiags"
 	"github.com/mitchellh/go-homedir"
 	"github.com/zclconf/go-cty/cty"
@@ -31,15 +34,38 @@ type ProviderResolver struct {
 	KnownPlugins      map[addrs.Provider]discovery.PluginMeta
 	DataSourceReader  *MockDataSourceReader
 	ResourceCreator   *FakeResourceCreator
+	ConfigRecorder    *ProviderConfigRecorder
 	ConfigureProvider bool
 }
 
 // MockDataSourceReader can mock a call to ReadDataSource and return appropriate mocked data
 type MockDataSourceReader struct {
-	mockDataSources []*Mock
-	unmatchedCalls  []cty.Value
-	providerConfigs map[string]cty.Value
-	mux             sync.RWMutex
+	mockDataSources     []*Mock
+	calls               []*DataSourceCall
+	unmatchedCalls      []*DataSourceCall
+	ambiguousCalls      []*AmbiguousCall
+	resolvedCalls       []*DataSourceCall
+	unresolvedAddresses []string
+	providerConfigs     map[string]cty.Value
+	autoMockSchemas     *terraform.Schemas
+	mux                 sync.RWMutex
+}
+
+// DataSourceCall holds the type and configuration of a data source call.
+// Address is only known once terraform has processed the returned Result, or when an identical call
+// was made for a single data source before the mocks were reset, like while refreshing before the plan
+type DataSourceCall struct {
+	Type           string
+	Address        string
+	Config         cty.Value
+	ProviderConfig cty.Value
+	Result         cty.Value
+}
+
+// AmbiguousCall holds a data source call that matched several mocks
+type AmbiguousCall struct {
+	*DataSourceCall
+	Mocks []*Mock
 }
 
 // SetMock populates mock data
@@ -52,45 +78,348 @@ func (m *MockDataSourceReader) SetProviderConfig(providerConfigs map[string]cty.
 	m.providerConfigs = providerConfigs
 }
 
+// SetAutoMock enables the auto mocking of unmatched data source calls.
+// Placeholder values are built from the data source schema found in given schemas
+func (m *MockDataSourceReader) SetAutoMock(schemas *terraform.Schemas) {
+	m.autoMockSchemas = schemas
+}
+
 // ReadDataSource returns a mock response for the datasource call
 func (m *MockDataSourceReader) ReadDataSource(typeName string, config cty.Value, providerConfig cty.Value) cty.Value {
-	var mockedResult cty.Value = config
-	var candidate *Mock
+	call := &DataSourceCall{Type: typeName, Config: config, ProviderConfig: providerConfig}
+	addresses := m.knownAddresses(call)
+	if len(addresses) == 1 {
+		call.Address = addresses[0]
+	}
+	call.Result = m.mockedResult(call, addresses)
+	m.mux.Lock()
+	m.calls = append(m.calls, call)
+	m.mux.Unlock()
+	return call.Result
+}
+
+// knownAddresses returns the addresses of the data sources an identical call was made for before the mocks were reset.
+// Providers are never given the address of the data source they read, so it can only be known
+// from the calls terraform already reported through DataSourceHook
+func (m *MockDataSourceReader) knownAddresses(call *DataSourceCall) []string {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	addresses := make([]string, 0)
+	for _, resolved := range m.resolvedCalls {
+		if resolved.Type == call.Type && sameValue(resolved.Config, call.Config) && sameValue(resolved.ProviderConfig, call.ProviderConfig) && !containsString(addresses, resolved.Address) {
+			addresses = append(addresses, resolved.Address)
+		}
+	}
+	return addresses
+}
+
+func (m *MockDataSourceReader) mockedResult(call *DataSourceCall, addresses []string) cty.Value {
+	var mockedResult cty.Value = call.Config
+	var matches, candidates, scoped []*Mock
 	for _, mock := range m.mockDataSources {
-		if typeName == mock.Type && mock.Query.RawEquals(config) {
-			if pc, ok := m.providerConfigs[mock.ProviderAlias]; ok && pc.RawEquals(providerConfig) {
-				mockedResult = mock.Call()
-				return mockedResult
-			}
-			if candidate == nil {
-				candidate = mock
+		if call.Type == mock.Type && mock.Matches(call.Config) {
+			if mock.Address != "" {
+				if mock.MatchesAddresses(addresses) {
+					scoped = append(scoped, mock)
+				}
+			} else if pc, ok := m.providerConfigs[mock.ProviderAlias]; ok && pc.RawEquals(call.ProviderConfig) {
+				matches = append(matches, mock)
+			} else {
+				candidates = append(candidates, mock)
 			}
 		}
 	}
-	// if caller's providerConfig matches default provider's config, then return the first candidate, if any
-	if candidate != nil {
-		if pc, ok := m.providerConfigs[strings.Split(typeName, "_")[0]]; !ok || pc.RawEquals(providerConfig) {
-			mockedResult = candidate.Call()
-			return mockedResult
+	// mocks targeting the address of the data source take precedence
+	if len(scoped) > 0 {
+		matches = scoped
+	}
+	// if caller's providerConfig matches default provider's config, then the candidates can be used
+	if len(matches) == 0 {
+		if pc, ok := m.providerConfigs[strings.Split(call.Type, "_")[0]]; !ok || pc.RawEquals(call.ProviderConfig) {
+			matches = candidates
+		}
+	}
+	if len(matches) > 0 {
+		if len(matches) > 1 && hasPartialMatch(matches) {
+			m.mux.Lock()
+			m.ambiguousCalls = append(m.ambiguousCalls, &AmbiguousCall{DataSourceCall: call, Mocks: matches})
+			m.mux.Unlock()
+		}
+		mockedResult = matches[0].Call()
+		if matches[0].PartialMatch {
+			// attributes not set in a partial mock are returned as they were queried
+			if completed, err := completeWith(mockedResult, call.Config); err == nil {
+				mockedResult = completed
+			}
 		}
+		return mockedResult
 	}
 
 	m.mux.Lock()
-	m.unmatchedCalls = append(m.unmatchedCalls, config)
+	m.unmatchedCalls = append(m.unmatchedCalls, call)
 	m.mux.Unlock()
 
+	if m.autoMockSchemas != nil {
+		if provSchema, err := LookupProviderSchema(m.autoMockSchemas, strings.Split(call.Type, "_")[0]); err == nil {
+			if schema, _ := provSchema.SchemaForResourceType(addrs.DataResourceMode, call.Type); schema != nil {
+				mockedResult = AutoMockValue(schema, call.Config)
+			}
+		}
+	}
+
 	return mockedResult
 }
 
+// SetCallAddress records the address of the data source that was given result, unless it was already known.
+// The address is set on the oldest call of the same type without address that returned this exact result.
+// When such calls were made with different configurations or providers, the call of the data source can't be
+// told apart from the others, so none of them is given the address, which is reported as unresolved instead
+func (m *MockDataSourceReader) SetCallAddress(addr addrs.AbsResourceInstance, result cty.Value) {
+	result, _ = result.UnmarkDeep()
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	candidates := make([]*DataSourceCall, 0)
+	for _, call := range m.calls {
+		if call.Address == addr.String() && call.Result.RawEquals(result) {
+			// the address was already known when the data source was read
+			return
+		}
+		if call.Address == "" && call.Type == addr.Resource.Resource.Type && call.Result.RawEquals(result) {
+			candidates = append(candidates, call)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	for _, call := range candidates[1:] {
+		if !sameValue(call.Config, candidates[0].Config) || !sameValue(call.ProviderConfig, candidates[0].ProviderConfig) {
+			m.unresolvedAddresses = append(m.unresolvedAddresses, addr.String())
+			return
+		}
+	}
+	candidates[0].Address = addr.String()
+}
+
+// UnresolvedAddresses returns the addresses of the data sources whose call couldn't be identified
+func (m *MockDataSourceReader) UnresolvedAddresses() []string {
+	m.mux.RLock()
+	ua := make([]string, len(m.unresolvedAddresses))
+	copy(ua, m.unresolvedAddresses)
+	m.mux.RUnlock()
+	return ua
+}
+
+// Calls returns the list of all data source calls
+func (m *MockDataSourceReader) Calls() []*DataSourceCall {
+	m.mux.RLock()
+	c := make([]*DataSourceCall, len(m.calls))
+	copy(c, m.calls)
+	m.mux.RUnlock()
+	return c
+}
+
+// ProviderConfig returns the configuration of the provider with the given alias, eg "aws.eu-west-2"
+func (m *MockDataSourceReader) ProviderConfig(alias string) (cty.Value, bool) {
+	pc, ok := m.providerConfigs[alias]
+	return pc, ok
+}
+
 // UnmatchedCalls returns the list of all data source calls that were not mocked
-func (m *MockDataSourceReader) UnmatchedCalls() []cty.Value {
+func (m *MockDataSourceReader) UnmatchedCalls() []*DataSourceCall {
 	m.mux.RLock()
-	uc := make([]cty.Value, len(m.unmatchedCalls))
+	uc := make([]*DataSourceCall, len(m.unmatchedCalls))
 	copy(uc, m.unmatchedCalls)
 	m.mux.RUnlock()
 	return uc
 }
 
+// sameValue indicates if both values are equal, including when none is set
+func sameValue(a, b cty.Value) bool {
+	if a.Type() == cty.NilType || b.Type() == cty.NilType {
+		return a.Type() == b.Type()
+	}
+	return a.RawEquals(b)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPartialMatch indicates if one of the given mocks uses partial matching.
+// Several exact mocks matching the same call keep returning the first one, as they always did
+func hasPartialMatch(mocks []*Mock) bool {
+	for _, mock := range mocks {
+		if mock.PartialMatch {
+			return true
+		}
+	}
+	return false
+}
+
+// AmbiguousCalls returns the list of all data source calls that matched several mocks
+func (m *MockDataSourceReader) AmbiguousCalls() []*AmbiguousCall {
+	m.mux.RLock()
+	ac := make([]*AmbiguousCall, len(m.ambiguousCalls))
+	copy(ac, m.ambiguousCalls)
+	m.mux.RUnlock()
+	return ac
+}
+
+// ProviderConfigRecorder finds the configuration of the providers used by the plan. The provider blocks of the
+// configuration are evaluated with the variables of the plan when they only depend on them. Otherwise, as providers
+// are never given their address, their configuration is found from the resources each provider planned
+type ProviderConfigRecorder struct {
+	plannedResources []*plannedResource
+	config           *configs.Config
+	mux              sync.Mutex
+}
+
+// plannedResource holds a planned resource and the configuration of the provider that planned it
+type plannedResource struct {
+	Type           string
+	Planned        cty.Value
+	ProviderConfig cty.Value
+}
+
+// SetConfig sets the configuration whose provider blocks are evaluated
+func (r *ProviderConfigRecorder) SetConfig(config *configs.Config) {
+	r.config = config
+}
+
+// RecordPlannedResource records that a provider with the given configuration planned the given resource
+func (r *ProviderConfigRecorder) RecordPlannedResource(typeName string, planned, providerConfig cty.Value) {
+	if providerConfig.Type() == cty.NilType {
+		// the provider wasn't configured
+		return
+	}
+	planned, _ = planned.UnmarkDeep()
+	r.mux.Lock()
+	r.plannedResources = append(r.plannedResources, &plannedResource{Type: typeName, Planned: planned, ProviderConfig: providerConfig})
+	r.mux.Unlock()
+}
+
+// ProviderConfigs returns the configuration of the providers used by the resources and data sources of the plan.
+// They're keyed like the ones of ProvidersMapFromConfig, eg "aws.eu-west-2", with the address of the provider
+// configuration the resources use. Providers that didn't plan any resource nor read any data source are missing.
+// The keys of the providers whose configuration can't be told apart from the one of other providers are returned as ambiguous
+func (r *ProviderConfigRecorder) ProviderConfigs(plan *plans.Plan, schemas *terraform.Schemas, calls []*DataSourceCall) (map[string]cty.Value, []string, error) {
+	configs := make(map[string]cty.Value)
+	ambiguous := make([]string, 0)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	evaluated := EvalProvidersMapFromConfig(r.config, schemas, planVariables(plan))
+	fromConfig := func(key string) bool {
+		if config, ok := evaluated[key]; ok && config.IsWhollyKnown() {
+			configs[key] = config
+			return true
+		}
+		return false
+	}
+
+	if plan.Changes != nil {
+		for _, resource := range plan.Changes.Resources {
+			key := providerConfigKey(resource.ProviderAddr)
+			addr := resource.Addr.Resource.Resource
+			if hasKey(configs, key) || addr.Mode != addrs.ManagedResourceMode || resource.Action == plans.Delete || fromConfig(key) {
+				continue
+			}
+			schema, _ := schemas.ResourceTypeConfig(resource.ProviderAddr.Provider, addr.Mode, addr.Type)
+			if schema == nil {
+				return nil, nil, fmt.Errorf("Could not find schema of resource %s", resource.Addr.String())
+			}
+			after, err := resource.After.Decode(schema.ImpliedType())
+			if err != nil {
+				return nil, nil, fmt.Errorf("Error happened while decoding planned resource %s : %v", resource.Addr.String(), err)
+			}
+			// identical resources planned by different providers don't tell which provider is which
+			var found []cty.Value
+			for _, planned := range r.plannedResources {
+				if planned.Type == addr.Type && planned.Planned.RawEquals(after) && !containsValue(found, planned.ProviderConfig) {
+					found = append(found, planned.ProviderConfig)
+				}
+			}
+			if len(found) == 1 {
+				configs[key] = found[0]
+			} else if len(found) > 1 && !containsString(ambiguous, key) {
+				ambiguous = append(ambiguous, key)
+			}
+		}
+	}
+
+	// data sources are read by the provider of their state
+	if plan.State != nil {
+		callConfigs := make(map[string]cty.Value)
+		for _, call := range calls {
+			if call.Address != "" && call.ProviderConfig.Type() != cty.NilType {
+				callConfigs[call.Address] = call.ProviderConfig
+			}
+		}
+		for _, module := range plan.State.Modules {
+			for _, resource := range module.Resources {
+				key := providerConfigKey(resource.ProviderConfig)
+				if resource.Addr.Resource.Mode != addrs.DataResourceMode || hasKey(configs, key) || fromConfig(key) {
+					continue
+				}
+				for instanceKey := range resource.Instances {
+					if config, ok := callConfigs[resource.Addr.Instance(instanceKey).String()]; ok {
+						configs[key] = config
+						break
+					}
+				}
+			}
+		}
+	}
+
+	// another resource or data source may have told the configuration of the provider
+	unresolved := make([]string, 0, len(ambiguous))
+	for _, key := range ambiguous {
+		if !hasKey(configs, key) {
+			unresolved = append(unresolved, key)
+		}
+	}
+	return configs, unresolved, nil
+}
+
+// planVariables returns the values of the root module variables the plan was computed with
+func planVariables(plan *plans.Plan) map[string]cty.Value {
+	values := make(map[string]cty.Value, len(plan.VariableValues))
+	for name, dv := range plan.VariableValues {
+		if val, err := dv.Decode(cty.DynamicPseudoType); err == nil {
+			values[name] = val
+		}
+	}
+	return values
+}
+
+// providerConfigKey returns the key of a provider configuration, made of its module path, name and alias
+func providerConfigKey(addr addrs.AbsProviderConfig) string {
+	key := providerPrefix(addr.Module) + addr.Provider.Type
+	if addr.Alias != "" {
+		key += "." + addr.Alias
+	}
+	return key
+}
+
+func hasKey(values map[string]cty.Value, key string) bool {
+	_, ok := values[key]
+	return ok
+}
+
+func containsValue(values []cty.Value, value cty.Value) bool {
+	for _, v := range values {
+		if v.RawEquals(value) {
+			return true
+		}
+	}
+	return false
+}
+
 // FakeResourceCreator can fake a resource creation by setting all resource attributes as defined in an assertion
 type FakeResourceCreator struct {
 	fakeResources []*Assert
@@ -236,6 +565,7 @@ func BuildProviderResolver(dir string, configureProvider bool) (*ProviderResolve
 		KnownPlugins:      pluginsSchema,
 		DataSourceReader:  &MockDataSourceReader{},
 		ResourceCreator:   &FakeResourceCreator{},
+		ConfigRecorder:    &ProviderConfigRecorder{},
 		ConfigureProvider: configureProvider,
 	}, nil
 }
@@ -270,7 +600,7 @@ func newClient(pluginName discovery.PluginMeta) *goplugin.Client {
 func (r *ProviderResolver) ResolveProviders() map[addrs.Provider]providers.Factory {
 	result := make(map[addrs.Provider]providers.Factory)
 	for k, p := range r.KnownPlugins {
-		result[k] = buildFactory(p, r.DataSourceReader, r.ResourceCreator, !r.ConfigureProvider)
+		result[k] = buildFactory(p, r.DataSourceReader, r.ResourceCreator, r.ConfigRecorder, !r.ConfigureProvider)
 	}
 
 	tfProvider := terraformProvider.NewProvider()
@@ -278,9 +608,9 @@ func (r *ProviderResolver) ResolveProviders() map[addrs.Provider]providers.Facto
 	return result
 }
 
-func buildFactory(p discovery.PluginMeta, dsProvider *MockDataSourceReader, resourceCreator *FakeResourceCreator, skipConfigure bool) providers.Factory {
+func buildFactory(p discovery.PluginMeta, dsProvider *MockDataSourceReader, resourceCreator *FakeResourceCreator, configRecorder *ProviderConfigRecorder, skipConfigure bool) providers.Factory {
 	return func() (providers.Interface, error) {
-		return &ProviderInterface{pluginMeta: p, dataSourceProvider: dsProvider, resourceCreator: resourceCreator, skipConfigure: skipConfigure}, nil
+		return &ProviderInterface{pluginMeta: p, dataSourceProvider: dsProvider, resourceCreator: resourceCreator, configRecorder: configRecorder, skipConfigure: skipConfigure}, nil
 	}
 }
 
@@ -296,6 +626,7 @@ type ProviderInterface struct {
 	pluginMeta         discovery.PluginMeta
 	dataSourceProvider *MockDataSourceReader
 	resourceCreator    *FakeResourceCreator
+	configRecorder     *ProviderConfigRecorder
 	_plugin            *plugin.GRPCProvider
 	lock               sync.Mutex
 	skipConfigure      bool
@@ -428,6 +759,9 @@ func (m *ProviderInterface) PlanResourceChange(req providers.PlanResourceChangeR
 		if !fake.IsNull() {
 			s.PlannedState = Merge(s.PlannedState, fake)
 		}
+		if m.configRecorder != nil && !s.Diagnostics.HasErrors() {
+			m.configRecorder.RecordPlannedResource(req.TypeName, s.PlannedState, m.config)
+		}
 	}
 	return s
 }
@@ -8,7 +8,11 @@ import (
 	"testing"
 
 	"github.com/hashicorp/terraform/addrs"
+	"github.com/hashicorp/terraform/configs/configschema"
+	"github.com/hashicorp/terraform/plans"
 	"github.com/hashicorp/terraform/plugin/discovery"
+	"github.com/hashicorp/terraform/states"
+	"github.com/hashicorp/terraform/terraform"
 	"github.com/zclconf/go-cty/cty"
 )
 
@@ -258,3 +262,411 @@ func TestReadDataSource(t *testing.T) {
 	}
 
 }
+
+func TestReadDataSourceAutoMock(t *testing.T) {
+	schemas := &terraform.Schemas{
+		Providers: map[addrs.Provider]*terraform.ProviderSchema{
+			addrs.NewDefaultProvider("prov"): {
+				DataSources: map[string]*configschema.Block{
+					"prov_type": {
+						Attributes: map[string]*configschema.Attribute{
+							"query":   {Type: cty.String, Optional: true},
+							"filter":  {Type: cty.String, Optional: true},
+							"ids":     {Type: cty.List(cty.String), Computed: true},
+							"count":   {Type: cty.Number, Computed: true},
+							"enabled": {Type: cty.Bool, Computed: true},
+							"tags":    {Type: cty.Map(cty.String), Optional: true, Computed: true},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	config := cty.ObjectVal(map[string]cty.Value{
+		"query":   cty.StringVal("123"),
+		"filter":  cty.NullVal(cty.String),
+		"ids":     cty.NullVal(cty.List(cty.String)),
+		"count":   cty.NullVal(cty.Number),
+		"enabled": cty.NullVal(cty.Bool),
+		"tags":    cty.NullVal(cty.Map(cty.String)),
+	})
+	expected := cty.ObjectVal(map[string]cty.Value{
+		"query":   cty.StringVal("123"),
+		"filter":  cty.NullVal(cty.String),
+		"ids":     cty.ListVal([]cty.Value{cty.StringVal("mock-ids")}),
+		"count":   cty.Zero,
+		"enabled": cty.False,
+		"tags":    cty.MapVal(map[string]cty.Value{"mock": cty.StringVal("mock-tags")}),
+	})
+
+	mdsr := &MockDataSourceReader{}
+	mdsr.SetAutoMock(schemas)
+
+	got := mdsr.ReadDataSource("prov_type", config, cty.NilVal)
+	if !got.RawEquals(expected) {
+		t.Errorf("ReadDataSource didn't return expected value. Got: %v\n Expected: %v", got.GoString(), expected.GoString())
+	}
+	if nb := len(mdsr.UnmatchedCalls()); nb != 1 {
+		t.Errorf("Auto mocked call should be recorded as unmatched. Got %d unmatched calls", nb)
+	}
+}
+
+func TestReadDataSourcePartialMatch(t *testing.T) {
+	config := cty.ObjectVal(map[string]cty.Value{
+		"query": cty.StringVal("123"),
+		"tag":   cty.StringVal("new-tag"),
+		"name":  cty.NullVal(cty.String),
+	})
+	partialQuery := cty.ObjectVal(map[string]cty.Value{
+		"query": cty.StringVal("123"),
+		"tag":   cty.NullVal(cty.String),
+		"name":  cty.NullVal(cty.String),
+	})
+	partialData := cty.ObjectVal(map[string]cty.Value{
+		"query": cty.StringVal("123"),
+		"tag":   cty.NullVal(cty.String),
+		"name":  cty.StringVal("partial"),
+	})
+	otherQuery := cty.ObjectVal(map[string]cty.Value{
+		"query": cty.NullVal(cty.String),
+		"tag":   cty.StringVal("new-tag"),
+		"name":  cty.NullVal(cty.String),
+	})
+
+	mockExact := &Mock{TypeName: TypeName{Type: "prov_type", Name: "exact"}, Query: partialQuery, Data: partialData, ProviderAlias: "prov"}
+	mockPartial := &Mock{TypeName: TypeName{Type: "prov_type", Name: "partial"}, Query: partialQuery, Data: partialData, ProviderAlias: "prov", PartialMatch: true}
+	mockOther := &Mock{TypeName: TypeName{Type: "prov_type", Name: "other"}, Query: otherQuery, Data: otherQuery, ProviderAlias: "prov", PartialMatch: true}
+
+	tests := map[string]struct {
+		mocks             []*Mock
+		expected          cty.Value
+		expectedAmbiguous int
+	}{
+		"exactMockShouldNotMatch": {
+			mocks:    []*Mock{mockExact},
+			expected: config,
+		},
+		"partialMockShouldMatch": {
+			mocks: []*Mock{mockExact, mockPartial},
+			expected: cty.ObjectVal(map[string]cty.Value{
+				"query": cty.StringVal("123"),
+				"tag":   cty.StringVal("new-tag"),
+				"name":  cty.StringVal("partial"),
+			}),
+		},
+		"ambiguousMocksShouldBeReported": {
+			mocks: []*Mock{mockOther, mockPartial},
+			expected: cty.ObjectVal(map[string]cty.Value{
+				"query": cty.StringVal("123"),
+				"tag":   cty.StringVal("new-tag"),
+				"name":  cty.NullVal(cty.String),
+			}),
+			expectedAmbiguous: 1,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			mdsr := &MockDataSourceReader{}
+			mdsr.SetMock(tt.mocks)
+
+			got := mdsr.ReadDataSource("prov_type", config, cty.NilVal)
+			if !got.RawEquals(tt.expected) {
+				t.Errorf("ReadDataSource didn't return expected value. Got: %v\n Expected: %v", got.GoString(), tt.expected.GoString())
+			}
+			if nb := len(mdsr.AmbiguousCalls()); nb != tt.expectedAmbiguous {
+				t.Errorf("Expected %d ambiguous calls. Got %d", tt.expectedAmbiguous, nb)
+			}
+		})
+	}
+}
+
+func TestReadDataSourceRecordsCalls(t *testing.T) {
+	first := cty.ObjectVal(map[string]cty.Value{"query": cty.StringVal("first")})
+	second := cty.ObjectVal(map[string]cty.Value{"query": cty.StringVal("second")})
+	providerConfig := cty.ObjectVal(map[string]cty.Value{"region": cty.StringVal("eu-west-1")})
+
+	mdsr := &MockDataSourceReader{}
+	hook := &DataSourceHook{Reader: mdsr}
+	mdsr.ReadDataSource("prov_type", first, providerConfig)
+	mdsr.ReadDataSource("prov_type", second, cty.NilVal)
+
+	dataAddr := func(name string, module addrs.ModuleInstance) addrs.AbsResourceInstance {
+		return addrs.Resource{Mode: addrs.DataResourceMode, Type: "prov_type", Name: name}.Instance(addrs.NoKey).Absolute(module)
+	}
+	hook.PostDiff(dataAddr("second", addrs.RootModuleInstance.Child("mod", addrs.NoKey)), states.CurrentGen, plans.Update, cty.NilVal, second)
+	hook.PostDiff(dataAddr("deferred", addrs.RootModuleInstance), states.CurrentGen, plans.Read, cty.NilVal, first)
+	hook.PostApply(dataAddr("first", addrs.RootModuleInstance), states.CurrentGen, first, nil)
+
+	calls := mdsr.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("Expected 2 recorded calls. Got %d", len(calls))
+	}
+	if calls[0].Address != "data.prov_type.first" || !calls[0].ProviderConfig.RawEquals(providerConfig) {
+		t.Errorf("Unexpected first call %s with provider config %v", calls[0].Address, calls[0].ProviderConfig.GoString())
+	}
+	if calls[1].Address != "module.mod.data.prov_type.second" || !calls[1].Config.RawEquals(second) {
+		t.Errorf("Unexpected second call %s with config %v", calls[1].Address, calls[1].Config.GoString())
+	}
+}
+
+func TestSetCallAddressThroughDifferentProviders(t *testing.T) {
+	config := cty.ObjectVal(map[string]cty.Value{"query": cty.StringVal("same")})
+	mainProvider := cty.ObjectVal(map[string]cty.Value{"region": cty.StringVal("eu-west-1")})
+	secondProvider := cty.ObjectVal(map[string]cty.Value{"region": cty.StringVal("eu-west-2")})
+
+	mdsr := &MockDataSourceReader{}
+	hook := &DataSourceHook{Reader: mdsr}
+	first := mdsr.ReadDataSource("prov_type", config, mainProvider)
+	second := mdsr.ReadDataSource("prov_type", config, secondProvider)
+
+	dataAddr := func(module string) addrs.AbsResourceInstance {
+		return addrs.Resource{Mode: addrs.DataResourceMode, Type: "prov_type", Name: "main"}.Instance(addrs.NoKey).Absolute(addrs.RootModuleInstance.Child(module, addrs.NoKey))
+	}
+	hook.PostDiff(dataAddr("second"), states.CurrentGen, plans.Update, cty.NilVal, second)
+	hook.PostDiff(dataAddr("first"), states.CurrentGen, plans.Update, cty.NilVal, first)
+
+	for _, call := range mdsr.Calls() {
+		if call.Address != "" {
+			t.Errorf("Call through provider %v shouldn't be given address %s", call.ProviderConfig.GoString(), call.Address)
+		}
+	}
+	unresolved := mdsr.UnresolvedAddresses()
+	if len(unresolved) != 2 || unresolved[0] != "module.second.data.prov_type.main" || unresolved[1] != "module.first.data.prov_type.main" {
+		t.Errorf("Unexpected unresolved addresses %v", unresolved)
+	}
+
+	spec := &Spec{DataSourceReader: mdsr}
+	diags := spec.validateDataAssert(&DataAssert{TypeName: TypeName{Type: "module.first.data.prov_type", Name: "main"}, Value: config})
+	if len(diags) != 1 {
+		t.Fatalf("Expected 1 diagnostic. Got %v", diags)
+	}
+	testDiagnostic(t, diags[0], ErrorDiags(cty.GetAttrPath("module.first.data.prov_type.main"), "the call of this data source can't be told apart from identical calls made with another configuration or provider"))
+}
+
+func TestReadDataSourceScopedMocks(t *testing.T) {
+	query := func(query string) cty.Value {
+		return cty.ObjectVal(map[string]cty.Value{
+			"query": cty.StringVal(query),
+			"name":  cty.NullVal(cty.String),
+		})
+	}
+	withName := func(query, name string) cty.Value {
+		return cty.ObjectVal(map[string]cty.Value{
+			"query": cty.StringVal(query),
+			"name":  cty.StringVal(name),
+		})
+	}
+	nameOnly := func(name string) cty.Value {
+		return cty.ObjectVal(map[string]cty.Value{
+			"query": cty.NullVal(cty.String),
+			"name":  cty.StringVal(name),
+		})
+	}
+	anyQuery := cty.ObjectVal(map[string]cty.Value{
+		"query": cty.NullVal(cty.String),
+		"name":  cty.NullVal(cty.String),
+	})
+
+	mdsr := &MockDataSourceReader{}
+	spec := &Spec{
+		DataSourceReader: mdsr,
+		Mocks: []*Mock{
+			{TypeName: TypeName{Type: "prov_type", Name: "main"}, Query: anyQuery, Data: nameOnly("default"), PartialMatch: true},
+			{TypeName: TypeName{Type: "prov_type", Name: "main"}, Query: anyQuery, Data: nameOnly("a"), Address: "module.a.data.prov_type.main", PartialMatch: true},
+			{TypeName: TypeName{Type: "prov_type", Name: "main[1]"}, Query: anyQuery, Data: nameOnly("b1"), Address: "module.b.data.prov_type.main[1]", PartialMatch: true},
+			{TypeName: TypeName{Type: "prov_type", Name: "main"}, Query: anyQuery, Data: nameOnly("c"), Address: "module.c.data.prov_type.main", PartialMatch: true},
+		},
+	}
+	mdsr.SetMock(spec.Mocks)
+
+	tests := []struct {
+		address  string
+		query    string
+		expected string
+	}{
+		{"module.a.data.prov_type.main[0]", "a0", "a"},
+		{"module.a.data.prov_type.main[1]", "a1", "a"},
+		{"module.b.data.prov_type.main[0]", "b0", "default"},
+		{"module.b.data.prov_type.main[1]", "b1", "b1"},
+		{"data.prov_type.main", "root", "default"},
+		// identical calls can't be told apart, so the mock of module.c doesn't apply
+		{"module.c.data.prov_type.main", "shared", "default"},
+		{"module.d.data.prov_type.main", "shared", "default"},
+	}
+
+	// while refreshing, terraform reports the address of each data source once it has been read
+	hook := &DataSourceHook{Reader: mdsr}
+	for _, tt := range tests {
+		got := mdsr.ReadDataSource("prov_type", query(tt.query), cty.NilVal)
+		if !got.RawEquals(withName(tt.query, "default")) {
+			t.Errorf("First ReadDataSource of %s should return the default mock. Got: %v", tt.address, got.GoString())
+		}
+		addr, diags := addrs.ParseAbsResourceInstanceStr(tt.address)
+		if diags.HasErrors() {
+			t.Fatal(diags.Err())
+		}
+		hook.PostDiff(addr, states.CurrentGen, plans.Update, cty.NilVal, got)
+	}
+
+	// while planning, identical calls are known to be made for the same data source
+	spec.ResetMocks()
+	for _, tt := range tests {
+		expected := withName(tt.query, tt.expected)
+		got := mdsr.ReadDataSource("prov_type", query(tt.query), cty.NilVal)
+		if !got.RawEquals(expected) {
+			t.Errorf("ReadDataSource of %s didn't return expected value. Got: %v\n Expected: %v", tt.address, got.GoString(), expected.GoString())
+		}
+	}
+}
+
+var providerConfigSchemas = &terraform.Schemas{
+	Providers: map[addrs.Provider]*terraform.ProviderSchema{
+		addrs.NewDefaultProvider("aws"): {
+			Provider: &configschema.Block{
+				Attributes: map[string]*configschema.Attribute{
+					"region": {Type: cty.String, Required: true},
+				},
+				BlockTypes: map[string]*configschema.NestedBlock{
+					"assume_role": {
+						Nesting: configschema.NestingList,
+						Block: configschema.Block{
+							Attributes: map[string]*configschema.Attribute{
+								"role_arn": {Type: cty.String, Optional: true},
+							},
+						},
+					},
+				},
+			},
+			ResourceTypes: map[string]*configschema.Block{
+				"aws_s3_bucket": {
+					Attributes: map[string]*configschema.Attribute{
+						"bucket": {Type: cty.String, Optional: true},
+					},
+				},
+			},
+			DataSources: map[string]*configschema.Block{
+				"aws_caller_identity": {
+					Attributes: map[string]*configschema.Attribute{
+						"account_id": {Type: cty.String, Computed: true},
+					},
+				},
+			},
+		},
+	},
+}
+
+func awsProviderConfig(region, roleArn string) cty.Value {
+	roleType := cty.Object(map[string]cty.Type{"role_arn": cty.String})
+	assumeRole := cty.ListValEmpty(roleType)
+	if roleArn != "" {
+		assumeRole = cty.ListVal([]cty.Value{cty.ObjectVal(map[string]cty.Value{"role_arn": cty.StringVal(roleArn)})})
+	}
+	return cty.ObjectVal(map[string]cty.Value{"region": cty.StringVal(region), "assume_role": assumeRole})
+}
+
+// recordedProviderConfigs returns a plan with buckets planned by the default and eu-west-2 aws providers,
+// and a data source read by the us-east-1 one, along with what the providers recorded while planning them
+func recordedProviderConfigs(t *testing.T) (*plans.Plan, *ProviderConfigRecorder, *MockDataSourceReader) {
+	defaultProvider := addrs.AbsProviderConfig{Module: addrs.RootModule, Provider: addrs.NewDefaultProvider("aws")}
+	euProvider := addrs.AbsProviderConfig{Module: addrs.RootModule, Provider: addrs.NewDefaultProvider("aws"), Alias: "eu-west-2"}
+	usProvider := addrs.AbsProviderConfig{Module: addrs.RootModule, Provider: addrs.NewDefaultProvider("aws"), Alias: "us-east-1"}
+	ty := providerConfigSchemas.Providers[defaultProvider.Provider].ResourceTypes["aws_s3_bucket"].ImpliedType()
+	bucket := func(name string, provider addrs.AbsProviderConfig) *plans.ResourceInstanceChangeSrc {
+		change := &plans.ResourceInstanceChange{
+			Addr:         addrs.Resource{Mode: addrs.ManagedResourceMode, Type: "aws_s3_bucket", Name: name}.Instance(addrs.NoKey).Absolute(addrs.RootModuleInstance),
+			ProviderAddr: provider,
+			Change:       plans.Change{Action: plans.Create, Before: cty.NullVal(ty), After: cty.ObjectVal(map[string]cty.Value{"bucket": cty.StringVal(name)})},
+		}
+		src, err := change.Encode(ty)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return src
+	}
+
+	recorder := &ProviderConfigRecorder{}
+	recorder.RecordPlannedResource("aws_s3_bucket", cty.ObjectVal(map[string]cty.Value{"bucket": cty.StringVal("default")}), awsProviderConfig("eu-west-1", ""))
+	recorder.RecordPlannedResource("aws_s3_bucket", cty.ObjectVal(map[string]cty.Value{"bucket": cty.StringVal("london")}), awsProviderConfig("eu-west-2", "arn:aws:iam::123456789012:role/deploy"))
+	recorder.RecordPlannedResource("aws_s3_bucket", cty.ObjectVal(map[string]cty.Value{"bucket": cty.StringVal("london")}), awsProviderConfig("eu-west-2", "arn:aws:iam::123456789012:role/deploy"))
+
+	reader := &MockDataSourceReader{}
+	result := reader.ReadDataSource("aws_caller_identity", cty.ObjectVal(map[string]cty.Value{"account_id": cty.UnknownVal(cty.String)}), awsProviderConfig("us-east-1", ""))
+	identity := addrs.Resource{Mode: addrs.DataResourceMode, Type: "aws_caller_identity", Name: "us"}.Instance(addrs.NoKey)
+	reader.SetCallAddress(identity.Absolute(addrs.RootModuleInstance), result)
+
+	state := states.NewState()
+	state.RootModule().SetResourceInstanceCurrent(identity, &states.ResourceInstanceObjectSrc{Status: states.ObjectReady, AttrsJSON: []byte(`{"account_id":null}`)}, usProvider)
+
+	plan := &plans.Plan{
+		Changes: &plans.Changes{Resources: []*plans.ResourceInstanceChangeSrc{bucket("default", defaultProvider), bucket("london", euProvider)}},
+		State:   state,
+	}
+	return plan, recorder, reader
+}
+
+func TestProviderConfigRecorder(t *testing.T) {
+	plan, recorder, reader := recordedProviderConfigs(t)
+	configs, ambiguous, err := recorder.ProviderConfigs(plan, providerConfigSchemas, reader.Calls())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]cty.Value{
+		"aws":           awsProviderConfig("eu-west-1", ""),
+		"aws.eu-west-2": awsProviderConfig("eu-west-2", "arn:aws:iam::123456789012:role/deploy"),
+		"aws.us-east-1": awsProviderConfig("us-east-1", ""),
+	}
+	if len(configs) != len(expected) {
+		t.Fatalf("Expected %d provider configs. Got %d : %v", len(expected), len(configs), configs)
+	}
+	if len(ambiguous) > 0 {
+		t.Errorf("No provider config should be ambiguous. Got %v", ambiguous)
+	}
+	for key, config := range expected {
+		if got, ok := configs[key]; !ok || !got.RawEquals(config) {
+			t.Errorf("Wrong config for %s. Got %s want %s", key, got.GoString(), config.GoString())
+		}
+	}
+}
+
+func TestProviderConfigRecorderAmbiguous(t *testing.T) {
+	plan, _, _ := recordedProviderConfigs(t)
+	recorder := &ProviderConfigRecorder{}
+	recorder.RecordPlannedResource("aws_s3_bucket", cty.ObjectVal(map[string]cty.Value{"bucket": cty.StringVal("london")}), awsProviderConfig("eu-west-2", ""))
+	recorder.RecordPlannedResource("aws_s3_bucket", cty.ObjectVal(map[string]cty.Value{"bucket": cty.StringVal("london")}), awsProviderConfig("eu-west-1", ""))
+	configs, ambiguous, err := recorder.ProviderConfigs(plan, providerConfigSchemas, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config, ok := configs["aws.eu-west-2"]; ok {
+		t.Errorf("A resource planned by two providers shouldn't tell the provider config. Got %s", config.GoString())
+	}
+	if len(ambiguous) != 1 || ambiguous[0] != "aws.eu-west-2" {
+		t.Errorf("aws.eu-west-2 should be reported as ambiguous. Got %v", ambiguous)
+	}
+}
+
+func TestProviderConfigRecorderEvaluatesConfig(t *testing.T) {
+	plan, _, _ := recordedProviderConfigs(t)
+	region, err := plans.NewDynamicValue(cty.StringVal("eu-west-2"), cty.DynamicPseudoType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan.VariableValues = map[string]plans.DynamicValue{"region": region}
+
+	recorder := &ProviderConfigRecorder{}
+	recorder.SetConfig(loadTestConfig(t, "testdata/providers_recorder"))
+	recorder.RecordPlannedResource("aws_s3_bucket", cty.ObjectVal(map[string]cty.Value{"bucket": cty.StringVal("london")}), awsProviderConfig("eu-west-2", ""))
+	recorder.RecordPlannedResource("aws_s3_bucket", cty.ObjectVal(map[string]cty.Value{"bucket": cty.StringVal("london")}), awsProviderConfig("eu-west-1", ""))
+	configs, ambiguous, err := recorder.ProviderConfigs(plan, providerConfigSchemas, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ambiguous) > 0 {
+		t.Errorf("Provider configs evaluated from the configuration shouldn't be ambiguous. Got %v", ambiguous)
+	}
+	if got, expected := configs["aws.eu-west-2"], awsProviderConfig("eu-west-2", "arn:aws:iam::123456789012:role/deploy"); !got.RawEquals(expected) {
+		t.Errorf("Wrong config for aws.eu-west-2. Got %s want %s", got.GoString(), expected.GoString())
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
@@ -19,27 +21,57 @@ import (
 	"github.com/hashicorp/terraform/terraform"
 	"github.com/hashicorp/terraform/tfdiags"
 	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
 )
 
 // Spec struct contains the assertions described in .tfspec file
 type Spec struct {
 	Asserts          []*Assert
-	Rejects          []*TypeName
+	DataAsserts      []*DataAssert
+	Rejects          []*Reject
+	Checks           []*Check
+	TagsPolicies     []*TagsPolicy
 	Mocks            []*Mock
 	DataSourceReader *MockDataSourceReader
+	ConfigRecorder   *ProviderConfigRecorder
 	Terraspec        *TerraspecConfig
+	schemas          *terraform.Schemas
 }
 
 // TerraspecConfig is a global element for a spec with common configuration similar to terraform hcl element.
 type TerraspecConfig struct {
 	Workspace string
+	AutoMock  bool
+	Strict    bool
+	Include   []string
 }
 
+// SharedDir is the name of the folder, next to the test case folders, containing spec files included in all test cases
+const SharedDir = "_shared"
+
 // Assert struct contains the definition of an assertion
 type Assert struct {
 	TypeName
-	Value  cty.Value
-	Return cty.Value
+	Value        cty.Value
+	Return       cty.Value
+	ErrorMessage string
+}
+
+// Reject struct contains the definition of a resource or output that must not be planned.
+// When Value isn't null, the resource can be planned but none of the attributes of Value must match
+type Reject struct {
+	TypeName
+	Value        cty.Value
+	ErrorMessage string
+}
+
+// DataAssert struct contains the definition of an assertion on the calls made to a data source
+type DataAssert struct {
+	TypeName
+	Value         cty.Value
+	ProviderAlias string
+	ExpectedCalls *int
+	ErrorMessage  string
 }
 
 // Mock struct contains the definition of mocked data resources
@@ -49,9 +81,28 @@ type Mock struct {
 	Data          cty.Value
 	Body          []byte
 	ProviderAlias string
+	Address       string
+	PartialMatch  bool
+	Sequence      []cty.Value
+	OnExhausted   string
+	ExpectedCalls *int
+	MinCalls      *int
+	MaxCalls      *int
+	ErrorMessage  string
 	calls         int
+	next          int
+	mux           sync.Mutex
 }
 
+const (
+	// RepeatLast makes an exhausted sequence of mock responses serve its last response again
+	RepeatLast = "repeat_last"
+	// Cycle makes an exhausted sequence of mock responses start over
+	Cycle = "cycle"
+	// FailWhenExhausted makes an exhausted sequence of mock responses serve its last response and report an error
+	FailWhenExhausted = "error"
+)
+
 // Context struct holds terraspec options and internal state
 type Context struct {
 	TerraformVersion  *goversion.Version
@@ -86,15 +137,128 @@ func (a *TypeName) Key() string {
 	return fmt.Sprintf("%s.%s", a.Type, a.Name)
 }
 
-// Call marks the mock as called and returns its data
+// Calls returns the calls made for the data source of this DataAssert, whatever their instance key
+func (a *DataAssert) Calls(calls []*DataSourceCall) []*DataSourceCall {
+	found := make([]*DataSourceCall, 0)
+	for _, call := range calls {
+		if a.MatchesAddress(call.Address) {
+			found = append(found, call)
+		}
+	}
+	return found
+}
+
+// MatchesAddress indicates if the given address is the one of the data source of this DataAssert, whatever its instance key
+func (a *DataAssert) MatchesAddress(address string) bool {
+	return address == a.Key() || strings.HasPrefix(address, a.Key()+"[")
+}
+
+// Call marks the mock as called and returns its data.
+// When the mock has a sequence of responses, they are returned in order, even across Reset
 func (m *Mock) Call() cty.Value {
+	m.mux.Lock()
+	defer m.mux.Unlock()
 	m.calls++
-	return m.Data
+	if len(m.Sequence) == 0 {
+		return m.Data
+	}
+	i := m.next
+	m.next++
+	if i >= len(m.Sequence) {
+		if m.OnExhausted == Cycle {
+			i = i % len(m.Sequence)
+		} else {
+			i = len(m.Sequence) - 1
+		}
+	}
+	return m.Sequence[i]
+}
+
+// Exhausted indicates if the mock was called more times than its sequence of responses allows.
+// Calls are counted since the first one, even across Reset, as they all consumed a response
+func (m *Mock) Exhausted() bool {
+	return m.OnExhausted == FailWhenExhausted && len(m.Sequence) > 0 && m.Served() > len(m.Sequence)
+}
+
+// Served returns the number of responses of the sequence the mock was asked for, even across Reset
+func (m *Mock) Served() int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.next
+}
+
+// CallCount returns the number of times the mock was called
+func (m *Mock) CallCount() int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.calls
+}
+
+// Reset sets the number of times the mock was called back to zero.
+// The position in the sequence of responses is kept, so that the next call gets the next response
+func (m *Mock) Reset() {
+	m.mux.Lock()
+	m.calls = 0
+	m.mux.Unlock()
+}
+
+// CallRange returns the minimum and maximum number of calls expected by the mock.
+// A negative maximum means there's no upper bound. Unless told otherwise, a mock expects to be called at least once
+func (m *Mock) CallRange() (int, int) {
+	if m.ExpectedCalls != nil {
+		return *m.ExpectedCalls, *m.ExpectedCalls
+	}
+	min, max := 1, -1
+	if m.MinCalls != nil {
+		min = *m.MinCalls
+	}
+	if m.MaxCalls != nil {
+		max = *m.MaxCalls
+		if m.MinCalls == nil && max < min {
+			min = max
+		}
+	}
+	return min, max
+}
+
+// Matches indicates if the given data source config matches the mock query.
+// A partial mock only requires the attributes set in its query to be equal
+func (m *Mock) Matches(config cty.Value) bool {
+	if m.PartialMatch {
+		return !checkAssert(cty.Path{}, m.Query, config).HasErrors()
+	}
+	query, _ := m.Query.UnmarkDeep()
+	return query.RawEquals(config)
+}
+
+// MatchesAddress indicates if the given data source address is the one targeted by the mock.
+// A mock targeting an address without instance key matches all the instances of the data source
+func (m *Mock) MatchesAddress(address string) bool {
+	return address == m.Address || strings.HasPrefix(address, m.Address+"[")
+}
+
+// MatchesAddresses indicates if the mock targets all the given data source addresses.
+// A call that could have been made for several data sources only matches a mock targeting all of them
+func (m *Mock) MatchesAddresses(addresses []string) bool {
+	for _, address := range addresses {
+		if !m.MatchesAddress(address) {
+			return false
+		}
+	}
+	return len(addresses) > 0
+}
+
+// path returns the path of the diagnostics reported about the mock
+func (m *Mock) path() cty.Path {
+	if m.Address != "" {
+		return cty.GetAttrPath(m.Address)
+	}
+	return cty.GetAttrPath(m.Type).GetAttr(m.Name)
 }
 
 // Called indicates if mock was called at least once
 func (m *Mock) Called() bool {
-	return m.calls > 0
+	return m.CallCount() > 0
 }
 
 // Validate checks all the assertions of this Spec against the given terraform Plan.
@@ -108,8 +272,29 @@ func (s *Spec) Validate(plan *plans.Plan) (tfdiags.Diagnostics, error) {
 		return diags, nil
 	}
 
+	var providerConfigs map[string]cty.Value
+	var ambiguousProviders []string
 	for _, assert := range s.Asserts {
-		if assert.Type == "output" {
+		if isProvider(assert.Type) {
+			if providerConfigs == nil {
+				var err error
+				if providerConfigs, ambiguousProviders, err = s.providerConfigs(plan); err != nil {
+					return nil, err
+				}
+			}
+			path := cty.GetAttrPath(assert.Key())
+			config, ok := providerConfigs[assert.Name]
+			if !ok && containsString(ambiguousProviders, assert.Name) {
+				diags = diags.Append(ErrorDiags(path, "Configuration is ambiguous : other providers planned the same resources with another configuration"))
+				continue
+			}
+			if !ok {
+				diags = diags.Append(ErrorDiags(path, "No resource or data source planned with this provider"))
+				continue
+			}
+			assertDiags := checkAssert(path, s.expected(assert.Value), config)
+			diags = diags.Append(withErrorMessage(assertDiags, assert.ErrorMessage))
+		} else if isOutput(assert.Type) {
 			output := findOuput(assert.Key(), plan.Changes.Outputs)
 			path := cty.GetAttrPath(assert.Key())
 			if output == nil {
@@ -121,8 +306,8 @@ func (s *Spec) Validate(plan *plans.Plan) (tfdiags.Diagnostics, error) {
 				return nil, fmt.Errorf("Error happened while decoding planned output %s : %v", assert.Name, err)
 			}
 
-			assertDiags := checkOutput(path, assert.Value, change.Change.After)
-			diags = diags.Append(assertDiags)
+			assertDiags := checkOutput(path, s.expected(assert.Value), change.Change.After, change.Sensitive)
+			diags = diags.Append(withErrorMessage(assertDiags, assert.ErrorMessage))
 		} else {
 			resource := findResource(assert.Key(), plan.Changes.Resources)
 			if resource == nil {
@@ -135,52 +320,201 @@ func (s *Spec) Validate(plan *plans.Plan) (tfdiags.Diagnostics, error) {
 				return nil, fmt.Errorf("Error happened while decoding planned resource %s : %v", assert.Name, err)
 			}
 
-			assertDiags := checkAssert(cty.GetAttrPath(assert.Key()), assert.Value, change)
-			diags = diags.Append(assertDiags)
+			assertDiags := checkAssert(cty.GetAttrPath(assert.Key()), s.expected(assert.Value), change)
+			diags = diags.Append(withErrorMessage(assertDiags, assert.ErrorMessage))
 		}
 	}
 
+	for _, assert := range s.DataAsserts {
+		diags = diags.Append(withErrorMessage(s.validateDataAssert(assert), assert.ErrorMessage))
+	}
+
 	for _, reject := range s.Rejects {
-		fmt.Println(reject.Key())
-		resource := findResource(reject.Key(), plan.Changes.Resources)
-		if resource != nil {
-			diags = diags.Append(RejectErrorDiags(cty.GetAttrPath(reject.Key()), reject, resource))
-		} else {
-			diags = diags.Append(RejectSuccessDiags(cty.GetAttrPath(reject.Key()), "Resource not created", reject))
+		rejectDiags, err := validateReject(reject, plan)
+		if err != nil {
+			return nil, err
+		}
+		diags = diags.Append(withErrorMessage(rejectDiags, reject.ErrorMessage))
+	}
+
+	if len(s.Checks) > 0 {
+		planned, err := plannedValues(plan, s.schemas)
+		if err != nil {
+			return nil, err
+		}
+		for _, check := range s.Checks {
+			diags = diags.Append(validateCheck(check, planned))
+		}
+	}
+
+	for _, policy := range s.TagsPolicies {
+		policyDiags, err := validateTagsPolicy(policy, plan, s.schemas)
+		if err != nil {
+			return nil, err
 		}
+		diags = diags.Append(policyDiags)
 	}
 
 	return diags, nil
 }
 
+// validateReject checks the given resource or output isn't planned, or isn't planned with the rejected values
+func validateReject(reject *Reject, plan *plans.Plan) (tfdiags.Diagnostics, error) {
+	var diags tfdiags.Diagnostics
+	path := cty.GetAttrPath(reject.Key())
+	if isOutput(reject.Type) {
+		if output := findOuput(reject.Key(), plan.Changes.Outputs); output != nil && output.Action != plans.Delete {
+			return diags.Append(ErrorDiags(path, "Output is planned")), nil
+		}
+		return diags.Append(RejectSuccessDiags(path, "Output not planned", reject)), nil
+	}
+	resource := findResource(reject.Key(), plan.Changes.Resources)
+	switch {
+	case resource == nil:
+		return diags.Append(RejectSuccessDiags(path, "Resource not created", reject)), nil
+	case reject.Value.IsNull():
+		return diags.Append(RejectErrorDiags(path, reject, resource)), nil
+	}
+	change, err := resource.After.Decode(reject.Value.Type())
+	if err != nil {
+		return nil, fmt.Errorf("Error happened while decoding planned resource %s : %v", reject.Name, err)
+	}
+	return checkReject(path, reject.Value, change), nil
+}
+
+// providerConfigs returns the configurations the providers used by the plan were configured with,
+// and the providers whose configuration is ambiguous
+func (s *Spec) providerConfigs(plan *plans.Plan) (map[string]cty.Value, []string, error) {
+	if s.ConfigRecorder == nil {
+		return map[string]cty.Value{}, nil, nil
+	}
+	var calls []*DataSourceCall
+	if s.DataSourceReader != nil {
+		calls = s.DataSourceReader.Calls()
+	}
+	return s.ConfigRecorder.ProviderConfigs(plan, s.schemas, calls)
+}
+
+// expected returns the value an assertion is checked with : in strict mode, it's marked so that
+// planned lists must have exactly the expected elements
+func (s *Spec) expected(value cty.Value) cty.Value {
+	if s.Terraspec != nil && s.Terraspec.Strict {
+		return withMatcher(value, strictMatcher)
+	}
+	return value
+}
+
+// validateDataAssert checks the calls made to a data source match the given assertion
+func (s *Spec) validateDataAssert(assert *DataAssert) tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+	path := cty.GetAttrPath(assert.Key())
+	calls := assert.Calls(s.DataSourceReader.Calls())
+	for _, address := range s.DataSourceReader.UnresolvedAddresses() {
+		if assert.MatchesAddress(address) {
+			diags = diags.Append(ErrorDiags(cty.GetAttrPath(address), "the call of this data source can't be told apart from identical calls made with another configuration or provider"))
+		}
+	}
+	if diags.HasErrors() {
+		return diags
+	}
+	if assert.ProviderAlias != "" {
+		providerConfig, ok := s.DataSourceReader.ProviderConfig(assert.ProviderAlias)
+		if !ok {
+			return diags.Append(ErrorDiags(path.GetAttr("provider"), fmt.Sprintf("Unknown provider %s", assert.ProviderAlias)))
+		}
+		withProvider := make([]*DataSourceCall, 0, len(calls))
+		for _, call := range calls {
+			if providerConfig.RawEquals(call.ProviderConfig) {
+				withProvider = append(withProvider, call)
+			}
+		}
+		calls = withProvider
+	}
+
+	if assert.ExpectedCalls != nil {
+		if len(calls) != *assert.ExpectedCalls {
+			diags = diags.Append(ErrorDiags(path, fmt.Sprintf("data source has been called %d time(s), expected %d", len(calls), *assert.ExpectedCalls)))
+		} else {
+			diags = diags.Append(SuccessDiags(path, fmt.Sprintf("data source has been called %d time(s)", len(calls))))
+		}
+	} else if len(calls) == 0 {
+		diags = diags.Append(ErrorDiags(path, "data source has not been called"))
+	}
+
+	for _, call := range calls {
+		diags = diags.Append(checkAssert(cty.GetAttrPath(call.Address), s.expected(assert.Value), call.Config))
+	}
+	return diags
+}
+
 // ValidateMocks checks all mocks were called as expected
 func (s *Spec) ValidateMocks() tfdiags.Diagnostics {
 	var diags tfdiags.Diagnostics
 	var allMissedCalls string
 	for _, mock := range s.Mocks {
-		if !mock.Called() {
+		calls := mock.CallCount()
+		min, max := mock.CallRange()
+		var diag tfdiags.Diagnostic
+		if calls == 0 && min > 0 {
 			if allMissedCalls == "" {
 				var sb strings.Builder
 				for _, call := range s.DataSourceReader.UnmatchedCalls() {
-					sb.Write(MarshalValue(call))
+					sb.Write(MarshalValue(call.Config))
 					sb.WriteString("\n")
 				}
 				allMissedCalls = sb.String()
 			}
-			diags = diags.Append(ErrorDiags(cty.GetAttrPath(mock.Type).GetAttr(mock.Name), fmt.Sprintf("No data resource matched :\n%s\nUncatched data source calls are :\n%s", string(mock.Body), allMissedCalls)))
+			diag = ErrorDiags(mock.path(), fmt.Sprintf("No data resource matched :\n%s\nUncatched data source calls are :\n%s", string(mock.Body), allMissedCalls))
+		} else if mock.Exhausted() {
+			diag = ErrorDiags(mock.path(), fmt.Sprintf("mock has been called %d time(s) but only has %d response(s)", mock.Served(), len(mock.Sequence)))
+		} else if min == max && calls != min {
+			diag = ErrorDiags(mock.path(), fmt.Sprintf("mock has been called %d time(s), expected %d", calls, min))
+		} else if calls < min {
+			diag = ErrorDiags(mock.path(), fmt.Sprintf("mock has been called %d time(s), expected at least %d", calls, min))
+		} else if max >= 0 && calls > max {
+			diag = ErrorDiags(mock.path(), fmt.Sprintf("mock has been called %d time(s), expected at most %d", calls, max))
 		} else {
-			diags = diags.Append(SuccessDiags(cty.GetAttrPath(mock.Type).GetAttr(mock.Name), fmt.Sprintf("mock has been called %d time(s)", mock.calls)))
+			diag = SuccessDiags(mock.path(), fmt.Sprintf("mock has been called %d time(s)", calls))
+		}
+		diags = diags.Append(withErrorMessage(tfdiags.Diagnostics{diag}, mock.ErrorMessage))
+	}
+	if s.DataSourceReader != nil {
+		for _, ambiguous := range s.DataSourceReader.AmbiguousCalls() {
+			names := make([]string, 0, len(ambiguous.Mocks))
+			for _, mock := range ambiguous.Mocks {
+				names = append(names, mock.Key())
+			}
+			diags = diags.Append(ErrorDiags(cty.GetAttrPath(ambiguous.Type), fmt.Sprintf("Data source call matches several mocks (%s), %s was used :\n%s", strings.Join(names, ", "), names[0], string(MarshalValue(ambiguous.Config)))))
+		}
+	}
+	if s.Terraspec != nil && s.Terraspec.AutoMock {
+		autoMocked := make([]*DataSourceCall, 0)
+		for _, call := range s.DataSourceReader.UnmatchedCalls() {
+			if containsCall(autoMocked, call) {
+				continue
+			}
+			autoMocked = append(autoMocked, call)
+			diags = diags.Append(WarningDiags(cty.GetAttrPath(call.Type), fmt.Sprintf("Data source not mocked, placeholder values returned for :\n%s", string(MarshalValue(call.Config)))))
 		}
 	}
 	return diags
 }
 
-// ResetMocks reset state related to mock calls
+// ResetMocks reset state related to mock calls.
+// Calls whose address is known are kept to find the address of the next identical calls
 func (s *Spec) ResetMocks() {
 	for _, mock := range s.Mocks {
-		mock.calls = 0
+		mock.Reset()
+	}
+	for _, call := range s.DataSourceReader.calls {
+		if call.Address != "" {
+			s.DataSourceReader.resolvedCalls = append(s.DataSourceReader.resolvedCalls, call)
+		}
 	}
+	s.DataSourceReader.calls = nil
 	s.DataSourceReader.unmatchedCalls = nil
+	s.DataSourceReader.ambiguousCalls = nil
+	s.DataSourceReader.unresolvedAddresses = nil
 }
 
 func findOuput(name string, outputs []*plans.OutputChangeSrc) *plans.OutputChangeSrc {
@@ -213,10 +547,52 @@ func findAttribute(key, value cty.Value) cty.Value {
 	return cty.NilVal
 }
 
+// checkAssert compares the expected value with the planned one.
+// Failures get the reason given with because() as summary, the innermost reason winning
 func checkAssert(path cty.Path, expected, got cty.Value) tfdiags.Diagnostics {
+	return withErrorMessage(checkValue(path, expected, got), reasonOf(expected.Marks()))
+}
+
+func checkValue(path cty.Path, expected, got cty.Value) tfdiags.Diagnostics {
 	var diags tfdiags.Diagnostics
+	expected, marks := expected.Unmark()
+	got, _ = got.Unmark()
+	// placeholder matchers only apply to the values returned by their function : marks of set elements are moved
+	// to the set itself by cty
+	if hasMatcher(marks, absentMatcher) && expected.IsNull() {
+		return checkAbsent(path, got)
+	}
+	if (hasMatcher(marks, unknownMatcher) || hasMatcher(marks, knownMatcher)) && !expected.IsKnown() {
+		return checkKnown(path, hasMatcher(marks, knownMatcher), got)
+	}
+	if !got.IsKnown() {
+		if expected.Type().IsPrimitiveType() {
+			return diags.Append(UnknownErrorDiags(path, PrimitiveValue(expected)))
+		}
+		return diags.Append(UnknownErrorDiags(path, nil))
+	}
+	if length, ok := lengthOf(marks); ok && !expected.IsKnown() {
+		return checkLength(path, length, got)
+	}
+	if hasMatcher(marks, jsonMatcher) && expected.Type() == cty.String {
+		return checkJSON(path, expected, got)
+	}
+	if tolerance, ok := toleranceOf(marks); ok && expected.Type() == cty.Number {
+		return checkApprox(path, expected, tolerance, got)
+	}
 	if expected.Type().IsPrimitiveType() {
-		if !got.IsKnown() || !expected.Equals(got).True() {
+		if !expected.IsNull() && !got.IsNull() && got.Type().IsPrimitiveType() && !expected.Type().Equals(got.Type()) {
+			// dynamic attributes may hold numbers and booleans as strings, or the other way around
+			if converted, err := convert.Convert(expected, got.Type()); err == nil {
+				expected = converted
+			}
+		}
+		if expected.Type() == cty.String && got.IsKnown() && !got.IsNull() && got.Type() == cty.String &&
+			!expected.Equals(got).True() && isJSON(expected.AsString()) && isJSON(got.AsString()) {
+			// JSON documents are compared whatever their formatting
+			return checkJSON(path, expected, got)
+		}
+		if !expected.Equals(got).True() {
 			diags = diags.Append(AssertErrorDiags(path, PrimitiveValue(expected), PrimitiveValue(got)))
 		} else {
 			diags = diags.Append(SuccessDiags(path, PrimitiveValue(got)))
@@ -224,9 +600,16 @@ func checkAssert(path cty.Path, expected, got cty.Value) tfdiags.Diagnostics {
 		return diags
 	}
 	if expected.CanIterateElements() {
+		if got.IsNull() {
+			return diags.Append(ErrorDiags(path, "Missing value"))
+		}
 		if !got.CanIterateElements() {
-			diags = diags.Append(ErrorDiags(path, "Element don't have multiple properties"))
-			return diags
+			return diags.Append(typeMismatchDiags(path, expected, got))
+		}
+		strict := hasMatcher(marks, strictMatcher)
+		exact := strict && !hasMatcher(marks, containsAllMatcher)
+		if expected.Type().IsSetType() || hasMatcher(marks, unorderedMatcher) || hasMatcher(marks, containsAllMatcher) {
+			return checkAssertUnordered(path, expected, got, strict, exact)
 		}
 
 		it := expected.ElementIterator()
@@ -238,9 +621,12 @@ func checkAssert(path cty.Path, expected, got cty.Value) tfdiags.Diagnostics {
 				diags = diags.Append(checkReject(path.GetAttr(key.AsString()), value, got))
 				continue
 			}
-			if IsNull(value) {
+			if IsNull(value) && !value.ContainsMarked() {
 				continue //skip attributes with no spec
 			}
+			if strict {
+				value = withMatcher(value, strictMatcher)
+			}
 			if key.Type() == cty.String {
 				// Looping over object properties or a map
 				g := findAttribute(key, got)
@@ -256,36 +642,160 @@ func checkAssert(path cty.Path, expected, got cty.Value) tfdiags.Diagnostics {
 			}
 			childIndex++
 		}
+		if exact && (expected.Type().IsListType() || expected.Type().IsTupleType()) {
+			for ; gt.Next(); childIndex++ {
+				_, g := gt.Element()
+				diags = diags.Append(unexpectedElementDiags(path, childIndex, g))
+			}
+		}
 		return diags
 	}
 
 	return diags
 }
 
+// typeMismatchDiags reports an expected value that can't be compared with the planned one
+func typeMismatchDiags(path cty.Path, expected, got cty.Value) *TerraspecDiagnostic {
+	return ErrorDiags(path, fmt.Sprintf("Bad Assertion : Comparing %s with planned %s", expected.Type().FriendlyName(), got.Type().FriendlyName()))
+}
+
 // checkAssertAmong will test assertion among all element in given ElementIterator and only return
 // the diagnostict for the closest match
 func checkAssertAmong(path cty.Path, expected cty.Value, got cty.ElementIterator) tfdiags.Diagnostics {
-	var closestDiags, diags tfdiags.Diagnostics
-	// looping over a set or an array:
+	candidates := make([]cty.Value, 0)
 	for got.Next() {
 		_, g := got.Element()
-		diags = checkAssert(path, expected, g)
-		if closestDiags == nil {
-			closestDiags = diags
-		} else {
-			if Compare(closestDiags, diags) > 0 {
-				closestDiags = diags
-			}
+		candidates = append(candidates, g)
+	}
+	_, closestDiags := closestMatch(path, expected, candidates)
+	return closestDiags
+}
+
+// closestMatch tests assertion against all the candidates and returns the index of the closest match and its diagnostics.
+// It returns -1 if there's no candidate
+func closestMatch(path cty.Path, expected cty.Value, candidates []cty.Value) (int, tfdiags.Diagnostics) {
+	closest := -1
+	var closestDiags tfdiags.Diagnostics
+	for i, candidate := range candidates {
+		diags := checkAssert(path, expected, candidate)
+		if closest < 0 || Compare(closestDiags, diags) > 0 {
+			closest, closestDiags = i, diags
 		}
 		if !closestDiags.HasErrors() {
 			break // early break as soon as there's a successDiags
 		}
 	}
-	return closestDiags
+	return closest, closestDiags
+}
+
+// checkAssertUnordered checks every element of expected matches an element of got, whatever their order.
+// An element of got can only match a single expected element, so elements are paired to get as many matches
+// as possible. If exact is set, the elements of got matching no expected element are reported
+func checkAssertUnordered(path cty.Path, expected, got cty.Value, strict, exact bool) tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+	candidates := make([]cty.Value, 0)
+	if got.IsKnown() && !got.IsNull() {
+		for it := got.ElementIterator(); it.Next(); {
+			_, g := it.Element()
+			candidates = append(candidates, g)
+		}
+	}
+
+	// results holds the diagnostics of every expected element checked against every candidate
+	results := make([][]tfdiags.Diagnostics, 0)
+	for it := expected.ElementIterator(); it.Next(); {
+		_, value := it.Element()
+		if IsNull(value) && !value.ContainsMarked() {
+			continue //skip elements with no spec
+		}
+		if strict {
+			value = withMatcher(value, strictMatcher)
+		}
+		childPath := path.Index(cty.NumberIntVal(int64(len(results))))
+		childResults := make([]tfdiags.Diagnostics, len(candidates))
+		for i, candidate := range candidates {
+			childResults[i] = checkAssert(childPath, value, candidate)
+		}
+		results = append(results, childResults)
+	}
+
+	matched := matchElements(results, len(candidates))
+	paired := make([]bool, len(candidates))
+	for _, candidate := range matched {
+		if candidate >= 0 {
+			paired[candidate] = true
+		}
+	}
+	for childIndex, childResults := range results {
+		if matched[childIndex] >= 0 {
+			diags = diags.Append(childResults[matched[childIndex]])
+			continue
+		}
+		// report the closest element left unpaired
+		closest := -1
+		for i := range candidates {
+			if !paired[i] && (closest < 0 || Compare(childResults[closest], childResults[i]) > 0) {
+				closest = i
+			}
+		}
+		if closest < 0 {
+			diags = diags.Append(ErrorDiags(path.Index(cty.NumberIntVal(int64(childIndex))), fmt.Sprintf("Could not find any element matching child at index %d", childIndex)))
+		} else {
+			diags = diags.Append(childResults[closest])
+		}
+	}
+	if exact {
+		for i, g := range candidates {
+			if !paired[i] {
+				diags = diags.Append(unexpectedElementDiags(path, i, g))
+			}
+		}
+	}
+	return diags
+}
+
+// matchElements pairs each expected element with a candidate it matches without error, so that as many
+// expected elements as possible are paired. It returns the index of the candidate paired with each
+// expected element, or -1
+func matchElements(results [][]tfdiags.Diagnostics, candidates int) []int {
+	pairedWith := make([]int, candidates)
+	for i := range pairedWith {
+		pairedWith[i] = -1
+	}
+	// augment pairs the expected element with a free candidate, moving the ones already paired if needed
+	var augment func(expected int, visited []bool) bool
+	augment = func(expected int, visited []bool) bool {
+		for candidate, diags := range results[expected] {
+			if visited[candidate] || diags.HasErrors() {
+				continue
+			}
+			visited[candidate] = true
+			if pairedWith[candidate] < 0 || augment(pairedWith[candidate], visited) {
+				pairedWith[candidate] = expected
+				return true
+			}
+		}
+		return false
+	}
+	for expected := range results {
+		augment(expected, make([]bool, candidates))
+	}
+
+	matched := make([]int, len(results))
+	for i := range matched {
+		matched[i] = -1
+	}
+	for candidate, expected := range pairedWith {
+		if expected >= 0 {
+			matched[expected] = candidate
+		}
+	}
+	return matched
 }
 
 func checkReject(path cty.Path, rejected, got cty.Value) tfdiags.Diagnostics {
 	var diags tfdiags.Diagnostics
+	rejected, _ = rejected.Unmark()
 	if rejected.CanIterateElements() && !rejected.IsNull() {
 		it := rejected.ElementIterator()
 		for it.Next() {
@@ -324,15 +834,16 @@ func checkReject(path cty.Path, rejected, got cty.Value) tfdiags.Diagnostics {
 // checkRejectCollection will check all rejections of a colllection type
 func checkRejectCollection(path cty.Path, key cty.Value, reject, found cty.Value) tfdiags.Diagnostics {
 	var diags tfdiags.Diagnostics
+	reject, _ = reject.Unmark()
 	if reject.CanIterateElements() {
 		it := reject.ElementIterator()
 		for it.Next() {
 			_, r := it.Element()
-			var assertDiags tfdiags.Diagnostics
-			if found.Type().IsSetType() || found.Type().IsListType() {
-				assertDiags = checkAssertAmong(path, r, found.ElementIterator())
+			matches := false
+			if found.IsKnown() && !found.IsNull() && (found.Type().IsSetType() || found.Type().IsListType()) {
+				matches = !checkAssertAmong(path, r, found.ElementIterator()).HasErrors()
 			}
-			if assertDiags.HasErrors() {
+			if !matches {
 				//this means checkAssert is wrong, so found block doesn't match the reject block : it's a success
 				diags = diags.Append(RejectSuccessDiags(path, fmt.Sprintf("No attribute matching %v definition", key.AsString()), r))
 			} else {
@@ -344,71 +855,276 @@ func checkRejectCollection(path cty.Path, key cty.Value, reject, found cty.Value
 	return diags
 }
 
-func checkOutput(path cty.Path, expected, got cty.Value) tfdiags.Diagnostics {
+// checkOutput checks the planned value of an output and its sensitivity match the expected ones
+func checkOutput(path cty.Path, expected, got cty.Value, sensitive bool) tfdiags.Diagnostics {
 	var diags tfdiags.Diagnostics
+	expected, marks := expected.Unmark()
 
 	exp := findAttribute(cty.StringVal("value"), expected)
-	if exp.IsNull() {
+	expSensitive := findAttribute(cty.StringVal("sensitive"), expected)
+	if exp.IsNull() && !exp.IsMarked() && expSensitive.IsNull() {
 		//should never happen
-		diags = diags.Append(ErrorDiags(path, "Bad Assertion : Assertion on outputs should have a value parameter"))
+		diags = diags.Append(ErrorDiags(path, "Bad Assertion : Assertion on outputs should have a value or sensitive parameter"))
 		return diags
 	}
-	if got.Type().IsTupleType() != exp.Type().IsTupleType() {
-		diags = diags.Append(ErrorDiags(path, "Bad Assertion : Comparing different types"))
+	if !expSensitive.IsNull() {
+		if expSensitive.True() != sensitive {
+			diags = diags.Append(AssertErrorDiags(path.GetAttr("sensitive"), expSensitive.True(), sensitive))
+		} else {
+			diags = diags.Append(SuccessDiags(path.GetAttr("sensitive"), sensitive))
+		}
+	}
+	if exp.IsNull() && !exp.IsMarked() {
 		return diags
 	}
-	return checkAssert(path, exp, got)
+	got, _ = got.Unmark()
+	if exp.IsKnown() && !exp.IsNull() && got.IsKnown() && !got.IsNull() && exp.Type().IsPrimitiveType() != got.Type().IsPrimitiveType() {
+		return diags.Append(typeMismatchDiags(path, exp, got))
+	}
+	return diags.Append(checkAssert(path, exp.WithMarks(marks), got))
+}
+
+// SpecOptions holds the optional settings used to read and parse spec files
+type SpecOptions struct {
+	// Variables are the values of the input variables, referenced as var.<name> in the spec
+	Variables map[string]cty.Value
+	// RootDir is the folder containing the test case folders, where the shared folder is found.
+	// Shared spec files are only included when it's set
+	RootDir string
 }
 
-// ReadSpec reads the .tfspec file and returns the resulting Spec or a Diagnostics if error occured in the process
+// ReadSpec reads the .tfspec file and returns the resulting Spec or a Diagnostics if error occured in the process.
+// Spec files listed in the include attribute of the terraspec block are included in the returned Spec
 func ReadSpec(filename string, schemas *terraform.Schemas) (*Spec, tfdiags.Diagnostics) {
+	return ReadSpecWithOptions(filename, schemas, nil)
+}
+
+// ReadSpecWithOptions reads the .tfspec file like ReadSpec, with the given options.
+// The input variables referenced by the spec are given in options, ReadSpec reads specs without variables.
+// When options set RootDir, the spec files of its shared folder are included too (see IncludeShared)
+func ReadSpecWithOptions(filename string, schemas *terraform.Schemas, options *SpecOptions) (*Spec, tfdiags.Diagnostics) {
+	s, diags := readSpecFile(filename, schemas, options)
+	if diags.HasErrors() {
+		return s, diags
+	}
+
+	diags = diags.Append(s.IncludeShared(schemas, options))
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	for _, include := range s.Terraspec.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(filename), include)
+		}
+		included, moreDiags := readSpecFile(include, schemas, options)
+		diags = diags.Append(moreDiags)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		s.Include(included)
+	}
+	return s, diags
+}
+
+// IncludeShared adds to this Spec the spec files of the shared folder of options.RootDir, if set.
+// Shared mocks may not be called unless they tell how many calls they expect
+func (s *Spec) IncludeShared(schemas *terraform.Schemas, options *SpecOptions) tfdiags.Diagnostics {
+	var diags tfdiags.Diagnostics
+	if options == nil || options.RootDir == "" {
+		return diags
+	}
+	sharedFiles, err := filepath.Glob(filepath.Join(options.RootDir, SharedDir, "*.tfspec"))
+	if err != nil {
+		return diags.Append(err)
+	}
+	for _, sharedFile := range sharedFiles {
+		shared, moreDiags := readSpecFile(sharedFile, schemas, options)
+		diags = diags.Append(moreDiags)
+		if diags.HasErrors() {
+			return diags
+		}
+		for _, mock := range shared.Mocks {
+			if mock.ExpectedCalls == nil && mock.MinCalls == nil {
+				noCalls := 0
+				mock.MinCalls = &noCalls
+			}
+		}
+		s.Include(shared)
+	}
+	return diags
+}
+
+func readSpecFile(filename string, schemas *terraform.Schemas, options *SpecOptions) (*Spec, tfdiags.Diagnostics) {
 	spec, err := ioutil.ReadFile(filename)
 	var tfdiags tfdiags.Diagnostics
 	if err != nil {
 		return nil, tfdiags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Detail: err.Error(), Summary: "Failed to read file"})
 	}
 
-	s, diags := ParseSpec(spec, filename, schemas)
+	s, diags := ParseSpecWithOptions(spec, filename, schemas, options)
 	return s, tfdiags.Append(diags)
 
 }
 
+// Include adds to this Spec the assertions and mocks of the shared Spec.
+// Blocks of the shared Spec with the same labels as the ones of this Spec are ignored
+func (s *Spec) Include(shared *Spec) {
+	for _, assert := range shared.Asserts {
+		if !s.hasAssert(assert.TypeName) {
+			s.Asserts = append(s.Asserts, assert)
+		}
+	}
+	for _, assert := range shared.DataAsserts {
+		if !s.hasDataAssert(assert.TypeName) {
+			s.DataAsserts = append(s.DataAsserts, assert)
+		}
+	}
+	for _, reject := range shared.Rejects {
+		if !s.hasReject(reject.TypeName) {
+			s.Rejects = append(s.Rejects, reject)
+		}
+	}
+	for _, check := range shared.Checks {
+		if !s.hasCheck(check.Name) {
+			s.Checks = append(s.Checks, check)
+		}
+	}
+	for _, policy := range shared.TagsPolicies {
+		if !s.hasTagsPolicy(policy.Name) {
+			s.TagsPolicies = append(s.TagsPolicies, policy)
+		}
+	}
+	for _, mock := range shared.Mocks {
+		if !s.hasMock(mock) {
+			s.Mocks = append(s.Mocks, mock)
+		}
+	}
+}
+
+func (s *Spec) hasAssert(typeName TypeName) bool {
+	for _, assert := range s.Asserts {
+		if assert.TypeName == typeName {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Spec) hasDataAssert(typeName TypeName) bool {
+	for _, assert := range s.DataAsserts {
+		if assert.TypeName == typeName {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Spec) hasReject(typeName TypeName) bool {
+	for _, reject := range s.Rejects {
+		if reject.TypeName == typeName {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Spec) hasCheck(name string) bool {
+	for _, check := range s.Checks {
+		if check.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Spec) hasTagsPolicy(name string) bool {
+	for _, policy := range s.TagsPolicies {
+		if policy.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Spec) hasMock(mock *Mock) bool {
+	for _, m := range s.Mocks {
+		if m.TypeName == mock.TypeName && m.Address == mock.Address {
+			return true
+		}
+	}
+	return false
+}
+
 // ParseSpec parses the spec contained in the []byte parameter and returns the resulting Spec or a Diagnostics if error occured in the process
 func ParseSpec(spec []byte, filename string, schemas *terraform.Schemas) (*Spec, hcl.Diagnostics) {
+	return ParseSpecWithOptions(spec, filename, schemas, nil)
+}
+
+// ParseSpecWithOptions parses the spec like ParseSpec, with the given options.
+// The input variables referenced by the spec are given in options, ParseSpec parses specs without variables
+func ParseSpecWithOptions(spec []byte, filename string, schemas *terraform.Schemas, options *SpecOptions) (*Spec, hcl.Diagnostics) {
+	if options == nil {
+		options = &SpecOptions{}
+	}
 	type terraspec struct {
 		Body hcl.Body `hcl:",remain"`
 	}
+	type locals struct {
+		Body hcl.Body `hcl:",remain"`
+	}
 	type assert struct {
-		Type      string         `hcl:"type,label"`
-		Name      string         `hcl:"name,label"`
-		Config    hcl.Body       `hcl:",remain"`
-		DependsOn hcl.Expression `hcl:"depends_on,attr"`
+		Type         string         `hcl:"type,label"`
+		Name         string         `hcl:"name,label"`
+		Config       hcl.Body       `hcl:",remain"`
+		DependsOn    hcl.Expression `hcl:"depends_on,attr"`
+		ErrorMessage hcl.Expression `hcl:"error_message,attr"`
 	}
 	type mock struct {
-		Type     string   `hcl:"type,label"`
-		Name     string   `hcl:"name,label"`
-		Provider string   `hcl:"provider,optional"`
-		Config   hcl.Body `hcl:",remain"`
+		Type         string         `hcl:"type,label"`
+		Name         string         `hcl:"name,label"`
+		Provider     string         `hcl:"provider,optional"`
+		Match        string         `hcl:"match,optional"`
+		OnExhausted  string         `hcl:"on_exhausted,optional"`
+		Calls        *int           `hcl:"calls,optional"`
+		MinCalls     *int           `hcl:"min_calls,optional"`
+		MaxCalls     *int           `hcl:"max_calls,optional"`
+		ErrorMessage hcl.Expression `hcl:"error_message,attr"`
+		Config       hcl.Body       `hcl:",remain"`
 	}
 	type reject struct {
-		Type   string   `hcl:"type,label"`
+		Type         string         `hcl:"type,label"`
+		Name         string         `hcl:"name,label"`
+		ErrorMessage hcl.Expression `hcl:"error_message,attr"`
+		Config       hcl.Body       `hcl:",remain"`
+	}
+	type check struct {
+		Name   string   `hcl:"name,label"`
+		Config hcl.Body `hcl:",remain"`
+	}
+	type tagsPolicy struct {
 		Name   string   `hcl:"name,label"`
 		Config hcl.Body `hcl:",remain"`
 	}
 	type root struct {
-		Asserts []*assert `hcl:"assert,block"`
-		Expects []*assert `hcl:"expect,block"`
-		Rejects []*reject `hcl:"reject,block"`
-		Mocks   []*mock   `hcl:"mock,block"`
+		Asserts      []*assert     `hcl:"assert,block"`
+		Expects      []*assert     `hcl:"expect,block"`
+		Rejects      []*reject     `hcl:"reject,block"`
+		Checks       []*check      `hcl:"check,block"`
+		TagsPolicies []*tagsPolicy `hcl:"tags_policy,block"`
+		Mocks        []*mock       `hcl:"mock,block"`
+		Locals       []*locals     `hcl:"locals,block"`
 		// Modules   []*Module   `hcl:"module,block"`
 		Terraspec *terraspec `hcl:"terraspec,block"`
 	}
 
 	var r root
-	parsed := &Spec{}
+	parsed := &Spec{schemas: schemas}
 	file, diags := hclparse.NewParser().ParseHCL(spec, filename)
 	ctx := &hcl.EvalContext{
-		Variables: make(map[string]cty.Value),
+		Variables: map[string]cty.Value{
+			"var": cty.ObjectVal(options.Variables),
+		},
+		Functions: specFunctions(filepath.Dir(filename)),
 	}
 
 	if diags.HasErrors() {
@@ -429,23 +1145,84 @@ func ParseSpec(spec []byte, filename string, schemas *terraform.Schemas) (*Spec,
 		parsed.Terraspec = &TerraspecConfig{}
 	}
 
+	localBodies := make([]hcl.Body, 0, len(r.Locals))
+	for _, l := range r.Locals {
+		localBodies = append(localBodies, l.Body)
+	}
+	if diags := decodeLocals(localBodies, ctx); diags.HasErrors() {
+		return nil, diags
+	}
+
 	asserts := make([]*assert, 0, len(r.Asserts)+len(r.Expects))
 	asserts = append(asserts, r.Asserts...)
 	asserts = append(asserts, r.Expects...)
 
 	for _, assert := range asserts {
+		errorMessage, diags := decodeErrorMessage(assert.ErrorMessage, ctx)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		if dataType, ok := dataSourceType(assert.Type); ok {
+			dataAssert, diags := decodeDataAssert(assert.Config, dataType, schemas, ctx)
+			if diags.HasErrors() {
+				return nil, diags
+			}
+			dataAssert.TypeName = TypeName{Type: assert.Type, Name: assert.Name}
+			dataAssert.ErrorMessage = errorMessage
+			parsed.DataAsserts = append(parsed.DataAsserts, dataAssert)
+			continue
+		}
+		if isProvider(assert.Type) {
+			val, diags := decodeProviderBody(assert.Config, assert.Name, schemas, ctx)
+			if diags.HasErrors() {
+				return nil, diags
+			}
+			parsedAssert := NewAssert(assert.Type, assert.Name, val, cty.NilVal)
+			parsedAssert.ErrorMessage = errorMessage
+			parsed.Asserts = append(parsed.Asserts, parsedAssert)
+			continue
+		}
 		val, returnVal, diags := decodeBody(assert.Config, assert.Type, schemas, ctx)
 		if diags.HasErrors() {
 			return nil, diags
 		}
-		parsed.Asserts = append(parsed.Asserts, NewAssert(assert.Type, assert.Name, val, returnVal))
+		parsedAssert := NewAssert(assert.Type, assert.Name, val, returnVal)
+		parsedAssert.ErrorMessage = errorMessage
+		parsed.Asserts = append(parsed.Asserts, parsedAssert)
 	}
 
-	for _, assert := range r.Rejects {
-		parsed.Rejects = append(parsed.Rejects, &TypeName{Name: assert.Name, Type: assert.Type})
+	for _, reject := range r.Rejects {
+		val, diags := decodeRejectBody(reject.Config, reject.Type, schemas, ctx)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		errorMessage, diags := decodeErrorMessage(reject.ErrorMessage, ctx)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		parsed.Rejects = append(parsed.Rejects, &Reject{TypeName: TypeName{Type: reject.Type, Name: reject.Name}, Value: val, ErrorMessage: errorMessage})
+	}
+	for _, check := range r.Checks {
+		c, diags := decodeCheck(check.Name, check.Config, ctx)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		parsed.Checks = append(parsed.Checks, c)
+	}
+	for _, policy := range r.TagsPolicies {
+		p, diags := decodeTagsPolicy(policy.Name, policy.Config, ctx)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		parsed.TagsPolicies = append(parsed.TagsPolicies, p)
 	}
 	for _, mock := range r.Mocks {
-		query, mocked, diags := decodeMockBody(mock.Config, mock.Type, schemas, ctx)
+		// a mock labelled with a data source address only mocks this data source
+		dataType, address := mock.Type, ""
+		if t, ok := dataSourceType(mock.Type); ok {
+			dataType, address = t, fmt.Sprintf("%s.%s", mock.Type, mock.Name)
+		}
+		query, responses, diags := decodeMockBody(mock.Config, dataType, schemas, ctx)
 		if diags.HasErrors() {
 			return nil, diags
 		}
@@ -455,14 +1232,116 @@ func ParseSpec(spec []byte, filename string, schemas *terraform.Schemas) (*Spec,
 		}
 		p := mock.Provider
 		if p == "" {
-			p = strings.Split(mock.Type, "_")[0]
+			p = strings.Split(dataType, "_")[0]
+		}
+		m := NewMock(dataType, mock.Name, p, query, responses[0], body)
+		m.Address = address
+		if m.ErrorMessage, diags = decodeErrorMessage(mock.ErrorMessage, ctx); diags.HasErrors() {
+			return nil, diags
+		}
+		if len(responses) > 1 {
+			m.Sequence = responses
+		}
+		switch mock.OnExhausted {
+		case "":
+			m.OnExhausted = RepeatLast
+		case RepeatLast, Cycle, FailWhenExhausted:
+			m.OnExhausted = mock.OnExhausted
+		default:
+			diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Invalid on_exhausted", Subject: mock.Config.MissingItemRange().Ptr(), Detail: fmt.Sprintf("on_exhausted must be \"%s\", \"%s\" or \"%s\", got \"%s\"", RepeatLast, Cycle, FailWhenExhausted, mock.OnExhausted)})
+			return nil, diags
+		}
+		if mock.Calls != nil && (mock.MinCalls != nil || mock.MaxCalls != nil) {
+			diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Invalid calls", Subject: mock.Config.MissingItemRange().Ptr(), Detail: "calls can't be used together with min_calls or max_calls"})
+			return nil, diags
+		}
+		m.ExpectedCalls, m.MinCalls, m.MaxCalls = mock.Calls, mock.MinCalls, mock.MaxCalls
+		if min, max := m.CallRange(); min < 0 || (m.MaxCalls != nil && (max < 0 || min > max)) {
+			diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Invalid calls", Subject: mock.Config.MissingItemRange().Ptr(), Detail: "expected number of calls must be positive and min_calls can't be greater than max_calls"})
+			return nil, diags
+		}
+		switch mock.Match {
+		case "":
+			// the address is enough to identify the data source, so the query only has to match partially
+			m.PartialMatch = address != ""
+		case "exact":
+		case "partial":
+			m.PartialMatch = true
+		default:
+			diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Invalid match", Subject: mock.Config.MissingItemRange().Ptr(), Detail: fmt.Sprintf("match must be \"exact\" or \"partial\", got \"%s\"", mock.Match)})
+			return nil, diags
 		}
-		parsed.Mocks = append(parsed.Mocks, NewMock(mock.Type, mock.Name, p, query, mocked, body))
+		parsed.Mocks = append(parsed.Mocks, m)
 	}
 
 	return parsed, diags
 }
 
+// decodeLocals evaluates the attributes of locals blocks, in the order of their dependencies,
+// and makes them available as local.<name> in the given context
+func decodeLocals(bodies []hcl.Body, ctx *hcl.EvalContext) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	pending := make(map[string]*hcl.Attribute)
+	for _, body := range bodies {
+		attrs, moreDiags := body.JustAttributes()
+		diags = append(diags, moreDiags...)
+		for name, attr := range attrs {
+			if existing, ok := pending[name]; ok {
+				diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Duplicate local value definition", Subject: attr.NameRange.Ptr(), Detail: fmt.Sprintf("local value \"%s\" was already defined at %s", name, existing.NameRange)})
+				continue
+			}
+			pending[name] = attr
+		}
+	}
+	if diags.HasErrors() {
+		return diags
+	}
+
+	locals := make(map[string]cty.Value, len(pending))
+	ctx.Variables["local"] = cty.EmptyObjectVal
+	for len(pending) > 0 {
+		evaluated := false
+		for name, attr := range pending {
+			if dependsOnPending(attr.Expr, pending) {
+				continue
+			}
+			val, moreDiags := attr.Expr.Value(ctx)
+			diags = append(diags, moreDiags...)
+			if diags.HasErrors() {
+				return diags
+			}
+			locals[name] = val
+			ctx.Variables["local"] = cty.ObjectVal(locals)
+			delete(pending, name)
+			evaluated = true
+		}
+		if !evaluated {
+			names := make([]string, 0, len(pending))
+			for name := range pending {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Cycle in local values", Subject: pending[names[0]].NameRange.Ptr(), Detail: fmt.Sprintf("local values %s depend on each other", strings.Join(names, ", "))})
+		}
+	}
+	return diags
+}
+
+// dependsOnPending indicates if the given expression references one of the local values not evaluated yet
+func dependsOnPending(expr hcl.Expression, pending map[string]*hcl.Attribute) bool {
+	for _, traversal := range expr.Variables() {
+		if traversal.RootName() != "local" || len(traversal) < 2 {
+			continue
+		}
+		if step, ok := traversal[1].(hcl.TraverseAttr); ok {
+			if _, found := pending[step.Name]; found {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func decodeTerraspecConfig(body hcl.Body, ctx *hcl.EvalContext) (*TerraspecConfig, hcl.Diagnostics) {
 	spec := hcldec.ObjectSpec{
 		"workspace": &hcldec.AttrSpec{
@@ -470,6 +1349,21 @@ func decodeTerraspecConfig(body hcl.Body, ctx *hcl.EvalContext) (*TerraspecConfi
 			Type:     cty.String,
 			Required: false,
 		},
+		"auto_mock": &hcldec.AttrSpec{
+			Name:     "auto_mock",
+			Type:     cty.Bool,
+			Required: false,
+		},
+		"strict": &hcldec.AttrSpec{
+			Name:     "strict",
+			Type:     cty.Bool,
+			Required: false,
+		},
+		"include": &hcldec.AttrSpec{
+			Name:     "include",
+			Type:     cty.List(cty.String),
+			Required: false,
+		},
 	}
 
 	val, diags := hcldec.Decode(body, spec, nil)
@@ -478,14 +1372,33 @@ func decodeTerraspecConfig(body hcl.Body, ctx *hcl.EvalContext) (*TerraspecConfi
 	}
 
 	workspaceName := ""
+	autoMock := false
+	strict := false
+	var include []string
 	if !val.IsNull() {
-		workspace := val.GetAttr("workspace")
 		ctx.Variables["terraspec"] = val
-		workspaceName = workspace.AsString()
+		if workspace := val.GetAttr("workspace"); !workspace.IsNull() {
+			workspaceName = workspace.AsString()
+		}
+		if am := val.GetAttr("auto_mock"); !am.IsNull() {
+			autoMock = am.True()
+		}
+		if st := val.GetAttr("strict"); !st.IsNull() {
+			strict = st.True()
+		}
+		if inc := val.GetAttr("include"); !inc.IsNull() {
+			for it := inc.ElementIterator(); it.Next(); {
+				_, v := it.Element()
+				include = append(include, v.AsString())
+			}
+		}
 	}
 
 	return &TerraspecConfig{
 		Workspace: workspaceName,
+		AutoMock:  autoMock,
+		Strict:    strict,
+		Include:   include,
 	}, nil
 }
 
@@ -497,7 +1410,8 @@ func decodeBody(body hcl.Body, bodyType string, schemas *terraform.Schemas, ctx
 	if provName == "output" {
 		partialSchema = &configschema.Block{
 			Attributes: map[string]*configschema.Attribute{
-				"value": {Type: cty.DynamicPseudoType, Computed: false},
+				"value":     {Type: cty.DynamicPseudoType, Computed: false},
+				"sensitive": {Type: cty.Bool, Optional: true},
 			},
 		}
 	} else {
@@ -518,11 +1432,8 @@ func decodeBody(body hcl.Body, bodyType string, schemas *terraform.Schemas, ctx
 		partialSchema, _ = schema.SchemaForResourceType(addrs.ManagedResourceMode, rawType)
 	}
 
-	val, codedReturn, diags := hcldec.PartialDecode(body, partialSchema.DecoderSpec(), ctx)
-	if diags.HasErrors() {
-		return
-	}
-	if returnSchema == nil {
+	val, codedReturn, diags := decodeExpected(body, bodyType, partialSchema, ctx)
+	if diags.HasErrors() || returnSchema == nil {
 		return
 	}
 	returnVal, moreDiags := hcldec.Decode(codedReturn, returnSchema.DecoderSpec(), ctx)
@@ -530,11 +1441,114 @@ func decodeBody(body hcl.Body, bodyType string, schemas *terraform.Schemas, ctx
 	if diags.HasErrors() {
 		return
 	}
-	returnVal = returnVal.GetAttr("return")
+	// matchers only apply to assertions, returned values are given to terraform as is
+	returnVal, _ = returnVal.GetAttr("return").UnmarkDeep()
 	return
 }
 
-func decodeMockBody(body hcl.Body, bodyType string, schemas *terraform.Schemas, ctx *hcl.EvalContext) (query, mock cty.Value, diags hcl.Diagnostics) {
+// decodeExpected decodes the expected values of an assertion with the given schema.
+// The rest of the body, not described by the schema, is returned
+func decodeExpected(body hcl.Body, bodyType string, schema *configschema.Block, ctx *hcl.EvalContext) (cty.Value, hcl.Body, hcl.Diagnostics) {
+	// attributes holding objects are decoded as dynamic values and converted afterwards,
+	// so that the attributes of their objects can be left out
+	relaxedSchema, relaxed := relaxObjectAttributes(schema)
+	present := readPresence(body, relaxedSchema)
+	bodySchema := decodeSchema(relaxedSchema, []*presence{present})
+	val, rest, diags := hcldec.PartialDecode(body, bodySchema.DecoderSpec(), ctx)
+	if diags.HasErrors() {
+		return val, rest, diags
+	}
+	val, moreDiags := present.apply(val, relaxedSchema, bodySchema)
+	diags = append(diags, moreDiags...)
+	if diags.HasErrors() {
+		return val, rest, diags
+	}
+	if relaxed {
+		conformed, err := ConformValue(val, schema.ImpliedType())
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Invalid value", Subject: body.MissingItemRange().Ptr(), Detail: fmt.Sprintf("Cannot convert %s : %s", bodyType, tfdiags.FormatError(err))})
+			return val, rest, diags
+		}
+		val = conformed
+	}
+	return val, rest, diags
+}
+
+// decodeProviderBody decodes the expected configuration of a provider, named by its address like "aws.eu-west-2"
+func decodeProviderBody(body hcl.Body, name string, schemas *terraform.Schemas, ctx *hcl.EvalContext) (cty.Value, hcl.Diagnostics) {
+	var diags hcl.Diagnostics
+	provSchema, err := LookupProviderSchema(schemas, providerType(name))
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Cannot find schema", Detail: err.Error()})
+		return cty.NilVal, diags
+	}
+	if provSchema.Provider == nil {
+		diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Invalid provider", Subject: body.MissingItemRange().Ptr(), Detail: fmt.Sprintf("provider \"%s\" has no configuration", name)})
+		return cty.NilVal, diags
+	}
+	val, rest, diags := decodeExpected(body, "provider "+name, transformBlock(provSchema.Provider.NoneRequired()), ctx)
+	if diags.HasErrors() {
+		return val, diags
+	}
+	// the provider schema is the only one allowed in the block
+	_, moreDiags := hcldec.Decode(rest, hcldec.ObjectSpec{}, ctx)
+	return val, append(diags, moreDiags...)
+}
+
+// decodeErrorMessage evaluates the optional error_message attribute of a block
+func decodeErrorMessage(expr hcl.Expression, ctx *hcl.EvalContext) (string, hcl.Diagnostics) {
+	if expr == nil {
+		return "", nil
+	}
+	val, diags := expr.Value(ctx)
+	if diags.HasErrors() || val.IsNull() {
+		return "", diags
+	}
+	val, _ = val.UnmarkDeep()
+	message, err := convert.Convert(val, cty.String)
+	if err == nil && !message.IsKnown() {
+		err = fmt.Errorf("value must be known")
+	}
+	if err != nil {
+		return "", diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Unsuitable value type", Subject: expr.Range().Ptr(), Detail: fmt.Sprintf("Unsuitable value: %s", err.Error())})
+	}
+	return message.AsString(), diags
+}
+
+// decodeRejectBody decodes the attributes of a top level reject block with the schema of the rejected resource.
+// An empty body, which rejects the whole resource, is decoded as a null value
+func decodeRejectBody(body hcl.Body, bodyType string, schemas *terraform.Schemas, ctx *hcl.EvalContext) (val cty.Value, diags hcl.Diagnostics) {
+	val = cty.NilVal
+	b, ok := body.(*hclsyntax.Body)
+	if !ok {
+		return
+	}
+	// attributes of the reject block itself, like error_message, are hidden from its body
+	if attrs, _ := body.JustAttributes(); len(attrs) == 0 && len(b.Blocks) == 0 {
+		return
+	}
+	if isOutput(bodyType) {
+		diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Invalid reject", Subject: body.MissingItemRange().Ptr(), Detail: "reject blocks of outputs must be empty"})
+		return
+	}
+	rawType := resourceType(bodyType)
+	provSchema, err := LookupProviderSchema(schemas, strings.Split(rawType, "_")[0])
+	if err != nil {
+		diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Cannot find schema", Detail: err.Error()})
+		return
+	}
+	schema, _ := laxSchema(provSchema).SchemaForResourceType(addrs.ManagedResourceMode, rawType)
+	if schema == nil {
+		diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Invalid resource", Subject: body.MissingItemRange().Ptr(), Detail: fmt.Sprintf("resource \"%s\" does not exist", bodyType)})
+		return
+	}
+	return hcldec.Decode(body, schema.DecoderSpec(), ctx)
+}
+
+// decodeMockBody decodes the query of a mock and its responses.
+// Responses are read from the return blocks or the returns attribute, in order.
+// A mock without response returns its query
+func decodeMockBody(body hcl.Body, bodyType string, schemas *terraform.Schemas, ctx *hcl.EvalContext) (query cty.Value, responses []cty.Value, diags hcl.Diagnostics) {
 	var codedMock hcl.Body
 	provName := strings.Split(bodyType, "_")[0]
 	schema, err := LookupProviderSchema(schemas, provName)
@@ -552,25 +1566,102 @@ func decodeMockBody(body hcl.Body, bodyType string, schemas *terraform.Schemas,
 	if diags.HasErrors() {
 		return
 	}
-	mockedSchema := toMockSchema(partialSchema)
+	mockedSchema := toSequenceMockSchema(partialSchema)
 	mock, moreDiags := hcldec.Decode(codedMock, mockedSchema.DecoderSpec(), ctx)
 	diags = append(diags, moreDiags...)
 	if diags.HasErrors() {
 		return
 	}
-	mock = mock.GetAttr("return")
 
-	mock, err = cty.Transform(mock, func(path cty.Path, value cty.Value) (cty.Value, error) {
-		if value.IsNull() {
-			return path.Apply(query)
+	returnBlocks, returns := mock.GetAttr("return"), mock.GetAttr("returns")
+	if !returns.IsNull() {
+		if returnBlocks.LengthInt() > 0 {
+			diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Invalid mock", Subject: body.MissingItemRange().Ptr(), Detail: "return blocks and returns attribute can't be used together"})
+			return
+		}
+		if !returns.Type().IsTupleType() && !returns.Type().IsListType() {
+			diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Invalid mock", Subject: body.MissingItemRange().Ptr(), Detail: "returns attribute must be a list of objects"})
+			return
+		}
+	} else {
+		returns = returnBlocks
+	}
+
+	// matchers only apply to the query, returned values are given to terraform as is
+	unmarkedQuery, _ := query.UnmarkDeep()
+	for it := returns.ElementIterator(); it.Next(); {
+		_, response := it.Element()
+		response, _ = response.UnmarkDeep()
+		response, err = ConformValue(response, partialSchema.ImpliedType())
+		if err == nil {
+			response, err = completeWith(response, unmarkedQuery)
+		}
+		if err != nil {
+			diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Invalid mock", Subject: body.MissingItemRange().Ptr(), Detail: err.Error()})
+			return
 		}
-		return value, nil
+		responses = append(responses, response)
+	}
+	if len(responses) == 0 {
+		responses = append(responses, unmarkedQuery)
+	}
+
+	return
+}
+
+// completeWith returns value where all null attributes are set with the ones found at the same path in defaults
+func completeWith(value, defaults cty.Value) (cty.Value, error) {
+	return cty.Transform(value, func(path cty.Path, v cty.Value) (cty.Value, error) {
+		if v.IsNull() {
+			return path.Apply(defaults)
+		}
+		return v, nil
 	})
+}
+
+// decodeDataAssert decodes the body of an assertion on data source calls
+func decodeDataAssert(body hcl.Body, dataType string, schemas *terraform.Schemas, ctx *hcl.EvalContext) (*DataAssert, hcl.Diagnostics) {
+	type dataAssert struct {
+		Provider string   `hcl:"provider,optional"`
+		Calls    *int     `hcl:"calls,optional"`
+		Config   hcl.Body `hcl:",remain"`
+	}
+	var da dataAssert
+	diags := gohcl.DecodeBody(body, ctx, &da)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	if da.Calls != nil && *da.Calls < 0 {
+		diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Invalid calls", Subject: body.MissingItemRange().Ptr(), Detail: "expected number of calls must be positive"})
+		return nil, diags
+	}
+
+	provSchema, err := LookupProviderSchema(schemas, strings.Split(dataType, "_")[0])
 	if err != nil {
-		diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Detail: err.Error()})
+		diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Cannot find schema", Detail: err.Error()})
+		return nil, diags
 	}
+	schema, _ := provSchema.SchemaForResourceType(addrs.DataResourceMode, dataType)
+	if schema == nil {
+		diags = diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Invalid resource", Subject: body.MissingItemRange().Ptr(), Detail: fmt.Sprintf("data source \"%s\" does not exist", dataType)})
+		return nil, diags
+	}
+	val, moreDiags := hcldec.Decode(da.Config, schema.NoneRequired().DecoderSpec(), ctx)
+	diags = append(diags, moreDiags...)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	return &DataAssert{Value: val, ProviderAlias: da.Provider, ExpectedCalls: da.Calls}, diags
+}
 
-	return
+// dataSourceType extracts the data source type from a fully qualified data source name, eg module.name.data.dataType.
+// It returns false if the name doesn't refer to a data source
+func dataSourceType(fullName string) (string, bool) {
+	parts := strings.Split(fullName, ".")
+	if len(parts) < 2 || parts[len(parts)-2] != "data" {
+		return "", false
+	}
+	return parts[len(parts)-1], true
 }
 
 // Extract the resource type from a fully qualified resource name, eg module.name.resourceType
@@ -579,6 +1670,27 @@ func resourceType(fullName string) string {
 	return parts[len(parts)-1]
 }
 
+// isOutput indicates if the given block type targets outputs, either of the root module ("output")
+// or of a child module ("module.name.output")
+func isOutput(fullName string) bool {
+	return resourceType(fullName) == "output"
+}
+
+// isProvider indicates if the given block type targets provider configurations
+func isProvider(fullName string) bool {
+	return fullName == "provider"
+}
+
+// providerType extracts the provider name from the address of a provider configuration,
+// eg module.name.aws.alias
+func providerType(address string) string {
+	parts := strings.Split(address, ".")
+	for len(parts) > 2 && parts[0] == "module" {
+		parts = parts[2:]
+	}
+	return parts[0]
+}
+
 // laxSchema returns a schema with all resource types and their properties defined as optional
 func laxSchema(schema *terraform.ProviderSchema) *terraform.ProviderSchema {
 	laxed := &terraform.ProviderSchema{ResourceTypes: make(map[string]*configschema.Block, len(schema.ResourceTypes))}
@@ -620,6 +1732,48 @@ func transformBlock(original *configschema.Block) *configschema.Block {
 	return transformed
 }
 
+// relaxObjectAttributes returns a copy of the given schema where attributes whose type holds objects are dynamic.
+// It indicates if any attribute was changed
+func relaxObjectAttributes(original *configschema.Block) (*configschema.Block, bool) {
+	relaxed := &configschema.Block{
+		Attributes: make(map[string]*configschema.Attribute, len(original.Attributes)),
+		BlockTypes: make(map[string]*configschema.NestedBlock, len(original.BlockTypes)),
+	}
+	changed := false
+	for k, v := range original.Attributes {
+		if containsObjectType(v.Type) {
+			attr := *v
+			attr.Type = cty.DynamicPseudoType
+			relaxed.Attributes[k] = &attr
+			changed = true
+		} else {
+			relaxed.Attributes[k] = v
+		}
+	}
+	for k, v := range original.BlockTypes {
+		block, blockChanged := relaxObjectAttributes(&v.Block)
+		relaxed.BlockTypes[k] = &configschema.NestedBlock{Block: *block, MinItems: v.MinItems, MaxItems: v.MaxItems, Nesting: v.Nesting}
+		changed = changed || blockChanged
+	}
+	return relaxed, changed
+}
+
+func containsObjectType(t cty.Type) bool {
+	switch {
+	case t.IsObjectType():
+		return true
+	case t.IsCollectionType():
+		return containsObjectType(t.ElementType())
+	case t.IsTupleType():
+		for _, et := range t.TupleElementTypes() {
+			if containsObjectType(et) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // untransformType remove "reject" attributes from type definition
 func untransformType(t cty.Type) cty.Type {
 	if t.IsCollectionType() {
@@ -645,6 +1799,23 @@ func untransformType(t cty.Type) cty.Type {
 	return cty.Object(proto)
 }
 
+// toSequenceMockSchema returns the schema of a mock body, that can return a sequence of responses
+// either with several return blocks or with the returns attribute
+func toSequenceMockSchema(schema *configschema.Block) *configschema.Block {
+	laxed := schema.NoneRequired()
+	return &configschema.Block{
+		Attributes: map[string]*configschema.Attribute{
+			"returns": {Type: cty.DynamicPseudoType, Optional: true},
+		},
+		BlockTypes: map[string]*configschema.NestedBlock{
+			"return": {
+				Block:   *laxed,
+				Nesting: configschema.NestingList,
+			},
+		},
+	}
+}
+
 func toMockSchema(schema *configschema.Block) *configschema.Block {
 	laxed := schema.NoneRequired()
 	mocked := &configschema.Block{
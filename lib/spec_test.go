@@ -3,17 +3,41 @@ package terraspec
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/hashicorp/terraform/addrs"
 	"github.com/hashicorp/terraform/configs/configschema"
+	"github.com/hashicorp/terraform/plans"
 	"github.com/hashicorp/terraform/terraform"
 	"github.com/hashicorp/terraform/tfdiags"
 	"github.com/zclconf/go-cty/cty"
 )
 
 func readSpecWithSchemas(t *testing.T, tfSpecFile string) *Spec {
-	schemas := &terraform.Schemas{
+	return readSpecWithVariables(t, tfSpecFile, nil)
+}
+
+func readSpecWithVariables(t *testing.T, tfSpecFile string, variables map[string]cty.Value) *Spec {
+	return readSpecWithOptions(t, tfSpecFile, &SpecOptions{Variables: variables})
+}
+
+func readSpecWithOptions(t *testing.T, tfSpecFile string, options *SpecOptions) *Spec {
+	spec, diags := ReadSpecWithOptions(tfSpecFile, specSchemas(), options)
+	if diags.HasErrors() {
+		t.Fatal(diags.ErrWithWarnings())
+	}
+
+	if spec == nil {
+		t.Fatal("spec is nil")
+	}
+
+	return spec
+}
+
+// specSchemas returns the schemas of the resources and data sources of the spec files of testdata
+func specSchemas() *terraform.Schemas {
+	return &terraform.Schemas{
 		Providers: map[addrs.Provider]*terraform.ProviderSchema{
 			addrs.NewDefaultProvider("ressource"): {
 				ResourceTypes: map[string]*configschema.Block{
@@ -52,16 +76,6 @@ func readSpecWithSchemas(t *testing.T, tfSpecFile string) *Spec {
 			},
 		},
 	}
-	spec, diags := ReadSpec(tfSpecFile, schemas)
-	if diags.HasErrors() {
-		t.Fatal(diags.ErrWithWarnings())
-	}
-
-	if spec == nil {
-		t.Fatal("spec is nil")
-	}
-
-	return spec
 }
 
 func TestParsingWithWorkspace(t *testing.T) {
@@ -117,6 +131,17 @@ func TestParsingWithWorkspace(t *testing.T) {
 	}
 }
 
+func TestParsingStrict(t *testing.T) {
+	spec := readSpecWithSchemas(t, "testdata/scenario_strict.tfspec")
+
+	if !spec.Terraspec.Strict {
+		t.Errorf("terraspec strict mode should be enabled")
+	}
+	if expected := spec.expected(spec.Asserts[0].Value); !expected.IsMarked() {
+		t.Errorf("assertions should be checked strictly. Got %s", expected.GoString())
+	}
+}
+
 func TestParsingMockWithProvider(t *testing.T) {
 	spec := readSpecWithSchemas(t, "testdata/scenario_mock_provider.tfspec")
 
@@ -142,6 +167,258 @@ func TestParsingMockWithProvider(t *testing.T) {
 	}
 }
 
+func TestParsingMockWithMatch(t *testing.T) {
+	spec := readSpecWithSchemas(t, "testdata/scenario_mock_partial.tfspec")
+
+	if !spec.Mocks[0].PartialMatch {
+		t.Errorf("mocks[0] should use partial match")
+	}
+	if spec.Mocks[1].PartialMatch {
+		t.Errorf("mocks[1] should use exact match")
+	}
+}
+
+func TestParsingMockSequence(t *testing.T) {
+	spec := readSpecWithSchemas(t, "testdata/scenario_mock_sequence.tfspec")
+
+	response := func(id cty.Value, name cty.Value) cty.Value {
+		return cty.ObjectVal(map[string]cty.Value{
+			"id":    id,
+			"name":  name,
+			"query": cty.NumberIntVal(12345),
+		})
+	}
+	tests := map[string]struct {
+		mock        *Mock
+		onExhausted string
+		expected    []cty.Value
+	}{
+		"blocks": {
+			mock:        spec.Mocks[0],
+			onExhausted: Cycle,
+			expected:    []cty.Value{response(cty.NullVal(cty.Number), cty.StringVal("first")), response(cty.NullVal(cty.Number), cty.StringVal("second")), response(cty.NullVal(cty.Number), cty.StringVal("first"))},
+		},
+		"list": {
+			mock:        spec.Mocks[1],
+			onExhausted: RepeatLast,
+			expected:    []cty.Value{response(cty.NullVal(cty.Number), cty.StringVal("first")), response(cty.NumberIntVal(2), cty.NullVal(cty.String)), response(cty.NumberIntVal(2), cty.NullVal(cty.String))},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if tt.mock.OnExhausted != tt.onExhausted {
+				t.Errorf("mock.OnExhausted not as expected. Got %s Want %s", tt.mock.OnExhausted, tt.onExhausted)
+			}
+			for i, expected := range tt.expected {
+				if got := tt.mock.Call(); !got.RawEquals(expected) {
+					t.Errorf("Call #%d not as expected. \nGot %s\nWant %s", i, got.GoString(), expected.GoString())
+				}
+			}
+			if tt.mock.Exhausted() {
+				t.Errorf("mock shouldn't be reported as exhausted")
+			}
+		})
+	}
+}
+
+func TestMockSequenceAcrossReset(t *testing.T) {
+	mock := &Mock{
+		Sequence:    []cty.Value{cty.StringVal("refresh"), cty.StringVal("plan")},
+		OnExhausted: FailWhenExhausted,
+	}
+
+	if got := mock.Call(); !got.RawEquals(cty.StringVal("refresh")) {
+		t.Errorf("Refresh should get the first response. Got %s", got.GoString())
+	}
+	mock.Reset()
+	if got := mock.Call(); !got.RawEquals(cty.StringVal("plan")) {
+		t.Errorf("Plan should get the second response. Got %s", got.GoString())
+	}
+	if got := mock.CallCount(); got != 1 {
+		t.Errorf("Only the calls made since the reset should be counted. Got %d", got)
+	}
+	if mock.Exhausted() {
+		t.Errorf("mock shouldn't be reported as exhausted")
+	}
+
+	// a third call runs past the end of the sequence, even if the calls were counted again from zero
+	mock.Call()
+	if !mock.Exhausted() {
+		t.Errorf("mock should be reported as exhausted after 3 calls to a sequence of 2 responses")
+	}
+}
+
+func TestParsingMockWithAddress(t *testing.T) {
+	spec := readSpecWithSchemas(t, "testdata/scenario_mock_address.tfspec")
+
+	network := spec.Mocks[0]
+	if network.Type != "data_type" || network.Address != "module.network.data.data_type.main" || !network.PartialMatch {
+		t.Errorf("mocks[0] should partially match data_type module.network.data.data_type.main. Got %s %s (partial : %v)", network.Type, network.Address, network.PartialMatch)
+	}
+	if network.ProviderAlias != "data" {
+		t.Errorf("mocks[0] should use default provider. Got %s", network.ProviderAlias)
+	}
+	instance := spec.Mocks[1]
+	if instance.Address != "data.data_type.main[0]" || instance.PartialMatch {
+		t.Errorf("mocks[1] should exactly match data.data_type.main[0]. Got %s (partial : %v)", instance.Address, instance.PartialMatch)
+	}
+	if !instance.MatchesAddress("data.data_type.main[0]") || instance.MatchesAddress("data.data_type.main[1]") {
+		t.Errorf("mocks[1] should only match the first instance")
+	}
+	if !network.MatchesAddress("module.network.data.data_type.main[\"a\"]") || network.MatchesAddress("module.network.data.data_type.main_other") {
+		t.Errorf("mocks[0] should match all instances of module.network.data.data_type.main")
+	}
+}
+
+func TestParsingMockCalls(t *testing.T) {
+	spec := readSpecWithSchemas(t, "testdata/scenario_mock_calls.tfspec")
+
+	if min, max := spec.Mocks[0].CallRange(); min != 2 || max != 2 {
+		t.Errorf("mocks[0] should expect exactly 2 calls. Got [%d, %d]", min, max)
+	}
+	if min, max := spec.Mocks[1].CallRange(); min != 1 || max != 3 {
+		t.Errorf("mocks[1] should expect between 1 and 3 calls. Got [%d, %d]", min, max)
+	}
+}
+
+func TestParsingDataAssert(t *testing.T) {
+	spec := readSpecWithSchemas(t, "testdata/scenario_data_assert.tfspec")
+
+	if len(spec.Asserts) != 0 {
+		t.Errorf("data source assertions shouldn't be parsed as resource assertions. Got %d", len(spec.Asserts))
+	}
+	if len(spec.DataAsserts) != 2 {
+		t.Fatalf("expected 2 data source assertions. Got %d", len(spec.DataAsserts))
+	}
+	selected := spec.DataAsserts[0]
+	if selected.Key() != "data.data_type.selected" {
+		t.Errorf("Unexpected key %s", selected.Key())
+	}
+	if query := selected.Value.GetAttr("query"); !query.RawEquals(cty.NumberIntVal(12345)) {
+		t.Errorf("Unexpected query %v", query.GoString())
+	}
+	if selected.ExpectedCalls == nil || *selected.ExpectedCalls != 1 {
+		t.Errorf("data.data_type.selected should expect 1 call")
+	}
+	regional := spec.DataAsserts[1]
+	if regional.Key() != "module.mod.data.data_type.regional" || regional.ProviderAlias != "data.second" {
+		t.Errorf("Unexpected assertion %s with provider %s", regional.Key(), regional.ProviderAlias)
+	}
+	if regional.ExpectedCalls != nil {
+		t.Errorf("module.mod.data.data_type.regional shouldn't expect a number of calls")
+	}
+}
+
+func TestParsingWithSharedSpecs(t *testing.T) {
+	spec := readSpecWithOptions(t, "testdata/shared/case/scenario_shared.tfspec", &SpecOptions{RootDir: "testdata/shared"})
+
+	if len(spec.Asserts) != 1 || spec.Asserts[0].Key() != "ressource_type.shared" {
+		t.Errorf("shared assertion should be included. Got %d assertions", len(spec.Asserts))
+	}
+	mocks := make(map[string]*Mock, len(spec.Mocks))
+	for _, mock := range spec.Mocks {
+		mocks[mock.Key()] = mock
+	}
+	if len(spec.Mocks) != 4 || mocks["data_type.region"] == nil || mocks["data_type.counted"] == nil || mocks["data_type.extra"] == nil {
+		t.Fatalf("shared and included mocks should be merged with local ones. Got %d mocks", len(spec.Mocks))
+	}
+	if name := mocks["data_type.overridden"].Data.GetAttr("name"); !name.RawEquals(cty.StringVal("local")) {
+		t.Errorf("local mock should override the shared one. Got %v", name.GoString())
+	}
+
+	tests := map[string]struct {
+		min, max int
+	}{
+		"data_type.region":     {0, -1},
+		"data_type.counted":    {1, 1},
+		"data_type.overridden": {1, -1},
+		"data_type.extra":      {1, -1},
+	}
+	for key, tt := range tests {
+		if min, max := mocks[key].CallRange(); min != tt.min || max != tt.max {
+			t.Errorf("%s should expect between %d and %d calls. Got %d and %d", key, tt.min, tt.max, min, max)
+		}
+	}
+}
+
+func TestIncludeSharedWithoutSpecFile(t *testing.T) {
+	// a test case without spec file, like a generated one, only gets the shared specs
+	spec, hclDiags := ParseSpecWithOptions(nil, "", specSchemas(), nil)
+	if hclDiags.HasErrors() {
+		t.Fatal(hclDiags.Error())
+	}
+	if diags := spec.IncludeShared(specSchemas(), &SpecOptions{RootDir: "testdata/shared"}); diags.HasErrors() {
+		t.Fatal(diags.ErrWithWarnings())
+	}
+
+	if len(spec.Asserts) != 1 || len(spec.Mocks) != 3 {
+		t.Errorf("shared specs should be included. Got %d assertions and %d mocks", len(spec.Asserts), len(spec.Mocks))
+	}
+}
+
+func TestParsingWithoutRootDir(t *testing.T) {
+	// without root folder, the shared folder isn't looked for
+	spec := readSpecWithSchemas(t, "testdata/shared/scenario_root.tfspec")
+
+	if len(spec.Asserts) != 0 {
+		t.Errorf("shared assertion shouldn't be included. Got %d assertions", len(spec.Asserts))
+	}
+	if len(spec.Mocks) != 1 || spec.Mocks[0].Key() != "data_type.root" {
+		t.Errorf("shared mocks shouldn't be included. Got %d mocks", len(spec.Mocks))
+	}
+}
+
+func TestParsingWithLocalsAndVariables(t *testing.T) {
+	spec := readSpecWithVariables(t, "testdata/scenario_locals.tfspec", map[string]cty.Value{
+		"env":   cty.StringVal("dev"),
+		"query": cty.NumberIntVal(41),
+	})
+
+	if property := spec.Asserts[0].Value.GetAttr("property"); !property.RawEquals(cty.StringVal("dev-name")) {
+		t.Errorf("Unexpected property %v", property.GoString())
+	}
+	if query := spec.Mocks[0].Query.GetAttr("query"); !query.RawEquals(cty.NumberIntVal(42)) {
+		t.Errorf("Unexpected query %v", query.GoString())
+	}
+}
+
+func TestParsingWithFunctions(t *testing.T) {
+	spec := readSpecWithSchemas(t, "testdata/scenario_functions.tfspec")
+
+	expected := map[string]string{
+		"ressource_type.format": "dev-bucket",
+		"ressource_type.json":   `{"env":"dev"}`,
+		"ressource_type.subnet": "10.0.2.0/24",
+		"ressource_type.md5":    "e77989ed21758e78331b20e477fc5582",
+		"ressource_type.file":   "from file",
+	}
+	if len(spec.Asserts) != len(expected) {
+		t.Fatalf("Expected %d assertions. Got %d", len(expected), len(spec.Asserts))
+	}
+	for _, assert := range spec.Asserts {
+		if property := assert.Value.GetAttr("property"); !property.RawEquals(cty.StringVal(expected[assert.Key()])) {
+			t.Errorf("Unexpected property for %s : %v", assert.Key(), property.GoString())
+		}
+	}
+}
+
+func TestParsingLocalsErrors(t *testing.T) {
+	tests := map[string]string{
+		"cycle":     "locals {\n  a = local.b\n  b = local.a\n}\n",
+		"duplicate": "locals {\n  a = 1\n}\nlocals {\n  a = 2\n}\n",
+		"undefined": "locals {\n  a = var.undefined\n}\n",
+	}
+	for name, spec := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, diags := ParseSpec([]byte(spec), "test.tfspec", nil)
+			if !diags.HasErrors() {
+				t.Errorf("Parsing should fail")
+			}
+		})
+	}
+}
+
 func TestParsingNoWorkspace(t *testing.T) {
 
 	tests := map[string]string{
@@ -434,7 +711,7 @@ func TestCheckAssert(t *testing.T) {
 
 	expectedResult = expectedResult.Append(SuccessDiags(rootPath.GetAttr("set").Index(cty.NumberIntVal(0)).GetAttr("name"), "a"))
 	expectedResult = expectedResult.Append(AssertErrorDiags(rootPath.GetAttr("set").Index(cty.NumberIntVal(1)).GetAttr("name"), "x", "z"))
-	expectedResult = expectedResult.Append(ErrorDiags(rootPath.GetAttr("set").Index(cty.NumberIntVal(2)), "Could not find child at index 2"))
+	expectedResult = expectedResult.Append(AssertErrorDiags(rootPath.GetAttr("set").Index(cty.NumberIntVal(2)).GetAttr("name"), "y", "z"))
 
 	expectedResult = expectedResult.Append(AssertErrorDiags(rootPath.GetAttr("tags").GetAttr("Missing-Value"), "missing-tag", nil))
 	expectedResult = expectedResult.Append(SuccessDiags(rootPath.GetAttr("tags").GetAttr("Name"), "test-name"))
@@ -641,7 +918,7 @@ func TestCheckOutput(t *testing.T) {
 			given: cty.ObjectVal(map[string]cty.Value{
 				"novalue": cty.StringVal("no value !"),
 			}),
-			expected: ErrorDiags(path, "Bad Assertion : Assertion on outputs should have a value parameter"),
+			expected: ErrorDiags(path, "Bad Assertion : Assertion on outputs should have a value or sensitive parameter"),
 		},
 		"tuple_goodOutput": {
 			given: cty.ObjectVal(map[string]cty.Value{
@@ -659,7 +936,7 @@ func TestCheckOutput(t *testing.T) {
 			given: cty.ObjectVal(map[string]cty.Value{
 				"value": cty.StringVal("not a tuple !"),
 			}),
-			expected: ErrorDiags(path, "Bad Assertion : Comparing different types"),
+			expected: ErrorDiags(path, "Bad Assertion : Comparing string with planned tuple"),
 		},
 	}
 
@@ -672,7 +949,7 @@ func TestCheckOutput(t *testing.T) {
 			if strings.HasPrefix(name, "tuple_") {
 				got = output
 			}
-			result := checkOutput(path, tt.given, got)
+			result := checkOutput(path, tt.given, got, false)
 			if nb := len(result); nb != 1 {
 				t.Errorf("checkOutput should return only 1 diagsnostic, got %d", nb)
 				if nb == 0 {
@@ -706,6 +983,26 @@ func testDiagnostic(t *testing.T, got, expected tfdiags.Diagnostic) {
 	}
 }
 
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestMockConcurrentCalls(t *testing.T) {
+	mock := &Mock{Data: cty.StringVal("data")}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			mock.Call()
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if got := mock.CallCount(); got != 50 {
+		t.Errorf("mock should have been called 50 times. Got %d", got)
+	}
+}
+
 func TestValidateMocks(t *testing.T) {
 	var notCalledBody = `{
 id = 123456
@@ -747,6 +1044,62 @@ region = "us-east-1"
 			},
 			expected: SuccessDiags(cty.GetAttrPath("data_called").GetAttr("called"), "mock has been called 1 time(s)"),
 		},
+		"called too often": {
+			given: &Spec{
+				Mocks: []*Mock{
+					{TypeName: TypeName{Name: "called", Type: "data_called"}, ExpectedCalls: intPtr(1), calls: 2},
+				},
+			},
+			expected: ErrorDiags(cty.GetAttrPath("data_called").GetAttr("called"), "mock has been called 2 time(s), expected 1"),
+		},
+		"called less than min": {
+			given: &Spec{
+				Mocks: []*Mock{
+					{TypeName: TypeName{Name: "called", Type: "data_called"}, MinCalls: intPtr(2), calls: 1},
+				},
+			},
+			expected: ErrorDiags(cty.GetAttrPath("data_called").GetAttr("called"), "mock has been called 1 time(s), expected at least 2"),
+		},
+		"called more than max": {
+			given: &Spec{
+				Mocks: []*Mock{
+					{TypeName: TypeName{Name: "called", Type: "data_called"}, MaxCalls: intPtr(2), calls: 3},
+				},
+			},
+			expected: ErrorDiags(cty.GetAttrPath("data_called").GetAttr("called"), "mock has been called 3 time(s), expected at most 2"),
+		},
+		"never called as expected": {
+			given: &Spec{
+				Mocks: []*Mock{
+					{TypeName: TypeName{Name: "uncalled", Type: "data_not_called"}, MaxCalls: intPtr(0)},
+				},
+			},
+			expected: SuccessDiags(cty.GetAttrPath("data_not_called").GetAttr("uncalled"), "mock has been called 0 time(s)"),
+		},
+		"exhausted": {
+			given: &Spec{
+				Mocks: []*Mock{
+					{TypeName: TypeName{Name: "exhausted",
+						Type: "data_exhausted"},
+						Sequence:    []cty.Value{cty.StringVal("first"), cty.StringVal("second")},
+						OnExhausted: FailWhenExhausted,
+						calls:       1,
+						next:        3,
+					},
+				},
+			},
+			expected: ErrorDiags(cty.GetAttrPath("data_exhausted").GetAttr("exhausted"), "mock has been called 3 time(s) but only has 2 response(s)"),
+		},
+		"auto mocked": {
+			given: &Spec{
+				Terraspec: &TerraspecConfig{AutoMock: true},
+				DataSourceReader: &MockDataSourceReader{unmatchedCalls: []*DataSourceCall{
+					{Type: "data_unmatched", Config: cty.ObjectVal(map[string]cty.Value{"id": cty.NumberIntVal(123456)})},
+					{Type: "data_unmatched", Config: cty.ObjectVal(map[string]cty.Value{"id": cty.NumberIntVal(123456)})},
+				}},
+			},
+			expected: WarningDiags(cty.GetAttrPath("data_unmatched"), fmt.Sprintf("Data source not mocked, placeholder values returned for :\n%s", MarshalValue(cty.ObjectVal(map[string]cty.Value{"id": cty.NumberIntVal(123456)})))),
+		},
 	}
 
 	for name, tt := range tests {
@@ -764,3 +1117,557 @@ region = "us-east-1"
 		})
 	}
 }
+
+func TestValidateDataAsserts(t *testing.T) {
+	config := func(query int64) cty.Value {
+		return cty.ObjectVal(map[string]cty.Value{"query": cty.NumberIntVal(query), "name": cty.NullVal(cty.String)})
+	}
+	mainProvider := cty.ObjectVal(map[string]cty.Value{"region": cty.StringVal("eu-west-1")})
+	secondProvider := cty.ObjectVal(map[string]cty.Value{"region": cty.StringVal("eu-west-2")})
+	reader := &MockDataSourceReader{
+		calls: []*DataSourceCall{
+			{Type: "data_type", Address: "data.data_type.selected[0]", Config: config(1), ProviderConfig: mainProvider},
+			{Type: "data_type", Address: "data.data_type.selected[1]", Config: config(1), ProviderConfig: secondProvider},
+			{Type: "data_type", Address: "data.data_type.other", Config: config(2), ProviderConfig: mainProvider},
+		},
+		providerConfigs: map[string]cty.Value{"data": mainProvider, "data.second": secondProvider},
+	}
+
+	var tests = map[string]struct {
+		given    *DataAssert
+		expected tfdiags.Diagnostics
+	}{
+		"called with expected config": {
+			given: &DataAssert{TypeName: TypeName{Type: "data.data_type", Name: "selected"}, Value: config(1)},
+			expected: tfdiags.Diagnostics{
+				SuccessDiags(cty.GetAttrPath("data.data_type.selected[0]").GetAttr("query"), "1"),
+				SuccessDiags(cty.GetAttrPath("data.data_type.selected[1]").GetAttr("query"), "1"),
+			},
+		},
+		"called with another config": {
+			given: &DataAssert{TypeName: TypeName{Type: "data.data_type", Name: "other"}, Value: config(1)},
+			expected: tfdiags.Diagnostics{
+				AssertErrorDiags(cty.GetAttrPath("data.data_type.other").GetAttr("query"), "1", "2"),
+			},
+		},
+		"called once per provider": {
+			given: &DataAssert{TypeName: TypeName{Type: "data.data_type", Name: "selected"}, Value: config(1), ProviderAlias: "data.second", ExpectedCalls: intPtr(1)},
+			expected: tfdiags.Diagnostics{
+				SuccessDiags(cty.GetAttrPath("data.data_type.selected"), "data source has been called 1 time(s)"),
+				SuccessDiags(cty.GetAttrPath("data.data_type.selected[1]").GetAttr("query"), "1"),
+			},
+		},
+		"called too often": {
+			given: &DataAssert{TypeName: TypeName{Type: "data.data_type", Name: "other"}, Value: cty.ObjectVal(map[string]cty.Value{"query": cty.NullVal(cty.Number), "name": cty.NullVal(cty.String)}), ExpectedCalls: intPtr(0)},
+			expected: tfdiags.Diagnostics{
+				ErrorDiags(cty.GetAttrPath("data.data_type.other"), "data source has been called 1 time(s), expected 0"),
+			},
+		},
+		"not called": {
+			given: &DataAssert{TypeName: TypeName{Type: "module.mod.data.data_type", Name: "selected"}, Value: config(1)},
+			expected: tfdiags.Diagnostics{
+				ErrorDiags(cty.GetAttrPath("module.mod.data.data_type.selected"), "data source has not been called"),
+			},
+		},
+		"unknown provider": {
+			given: &DataAssert{TypeName: TypeName{Type: "data.data_type", Name: "selected"}, Value: config(1), ProviderAlias: "data.unknown"},
+			expected: tfdiags.Diagnostics{
+				ErrorDiags(cty.GetAttrPath("data.data_type.selected").GetAttr("provider"), "Unknown provider data.unknown"),
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			spec := &Spec{DataAsserts: []*DataAssert{tt.given}, DataSourceReader: reader}
+			got := spec.validateDataAssert(tt.given)
+			if len(got) != len(tt.expected) {
+				t.Fatalf("Expected %d diagnostics. Got %d : %v", len(tt.expected), len(got), got)
+			}
+			for i := range got {
+				testDiagnostic(t, got[i], tt.expected[i])
+			}
+		})
+	}
+}
+
+func TestParsingAbsent(t *testing.T) {
+	spec := readSpecWithSchemas(t, "testdata/scenario_absent.tfspec")
+	if len(spec.Asserts) != 4 {
+		t.Fatalf("Expected 4 assertions. Got %d", len(spec.Asserts))
+	}
+
+	tests := map[string]struct {
+		got   cty.Value
+		diags tfdiags.Diagnostics
+	}{
+		"ressource_type.null": {
+			got: cty.ObjectVal(map[string]cty.Value{
+				"property": cty.StringVal("value"),
+				"id":       cty.NumberIntVal(1),
+				"inner":    cty.ObjectVal(map[string]cty.Value{"inner_prop": cty.NullVal(cty.String)}),
+			}),
+			diags: tfdiags.Diagnostics{
+				SuccessDiags(cty.GetAttrPath("inner").GetAttr("inner_prop"), "value is absent"),
+				ErrorDiags(cty.GetAttrPath("property"), `Unexpected value "value", expected no value`),
+			},
+		},
+		"ressource_type.no_block": {
+			got: cty.ObjectVal(map[string]cty.Value{
+				"property": cty.NullVal(cty.String),
+				"id":       cty.NumberIntVal(1),
+				"inner":    cty.ObjectVal(map[string]cty.Value{"inner_prop": cty.StringVal("value")}),
+			}),
+			diags: tfdiags.Diagnostics{
+				SuccessDiags(cty.GetAttrPath("id"), 1),
+				ErrorDiags(cty.GetAttrPath("inner"), `Unexpected value {
+  inner_prop = "value"
+}, expected no value`),
+			},
+		},
+		"ressource_type.from_expression": {
+			got: cty.ObjectVal(map[string]cty.Value{
+				"property": cty.StringVal("value"),
+				"id":       cty.NullVal(cty.Number),
+				"inner":    cty.ObjectVal(map[string]cty.Value{"inner_prop": cty.StringVal("value")}),
+			}),
+			diags: tfdiags.Diagnostics{
+				SuccessDiags(cty.GetAttrPath("id"), "value is absent"),
+				ErrorDiags(cty.GetAttrPath("property"), `Unexpected value "value", expected no value`),
+			},
+		},
+		"output.empty": {
+			got: cty.NullVal(cty.String),
+			diags: tfdiags.Diagnostics{
+				SuccessDiags(cty.Path{}, "value is absent"),
+			},
+		},
+	}
+
+	for _, assert := range spec.Asserts {
+		tt := tests[assert.Key()]
+		t.Run(assert.Key(), func(t *testing.T) {
+			var diags tfdiags.Diagnostics
+			if assert.Type == "output" {
+				diags = checkOutput(cty.Path{}, assert.Value, tt.got, false)
+			} else {
+				diags = checkAssert(cty.Path{}, assert.Value, tt.got)
+			}
+			if len(diags) != len(tt.diags) {
+				t.Fatalf("Expected %d diagnostics. Got %d : %v", len(tt.diags), len(diags), diags)
+			}
+			for i := range diags {
+				testDiagnostic(t, diags[i], tt.diags[i])
+			}
+		})
+	}
+}
+
+func TestValidateOutputs(t *testing.T) {
+	outputChange := func(name string, value cty.Value, sensitive bool) *plans.OutputChangeSrc {
+		change := &plans.OutputChange{
+			Addr:      addrs.OutputValue{Name: name}.Absolute(addrs.RootModuleInstance),
+			Change:    plans.Change{Action: plans.Create, Before: cty.NullVal(cty.DynamicPseudoType), After: value},
+			Sensitive: sensitive,
+		}
+		src, err := change.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return src
+	}
+	plan := &plans.Plan{Changes: &plans.Changes{Outputs: []*plans.OutputChangeSrc{
+		outputChange("password", cty.StringVal("secret"), true),
+		outputChange("ids", cty.ListVal([]cty.Value{cty.StringVal("a"), cty.StringVal("b")}), false),
+		outputChange("tags", cty.MapVal(map[string]cty.Value{"env": cty.StringVal("dev"), "team": cty.StringVal("ops")}), false),
+	}}}
+
+	spec := &Spec{
+		Asserts: []*Assert{
+			NewAssert("output", "password", cty.ObjectVal(map[string]cty.Value{"value": cty.NullVal(cty.DynamicPseudoType), "sensitive": cty.False}), cty.NilVal),
+			NewAssert("output", "ids", cty.ObjectVal(map[string]cty.Value{"value": cty.TupleVal([]cty.Value{cty.StringVal("a")}), "sensitive": cty.NullVal(cty.Bool)}), cty.NilVal),
+			NewAssert("output", "tags", cty.ObjectVal(map[string]cty.Value{"value": cty.ObjectVal(map[string]cty.Value{"env": cty.StringVal("dev")}), "sensitive": cty.False}), cty.NilVal),
+		},
+		Rejects: []*Reject{{TypeName: TypeName{Type: "output", Name: "password"}}, {TypeName: TypeName{Type: "output", Name: "removed"}}},
+	}
+	expected := tfdiags.Diagnostics{
+		AssertErrorDiags(cty.GetAttrPath("output.password").GetAttr("sensitive"), false, true),
+		SuccessDiags(cty.GetAttrPath("output.ids").IndexInt(0), "a"),
+		SuccessDiags(cty.GetAttrPath("output.tags").GetAttr("sensitive"), false),
+		SuccessDiags(cty.GetAttrPath("output.tags").GetAttr("env"), "dev"),
+		ErrorDiags(cty.GetAttrPath("output.password"), "Output is planned"),
+		RejectSuccessDiags(cty.GetAttrPath("output.removed"), "Output not planned", nil),
+	}
+
+	diags, err := spec.Validate(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("Expected %d diagnostics. Got %d : %v", len(expected), len(diags), diags)
+	}
+	for i := range diags {
+		testDiagnostic(t, diags[i], expected[i])
+	}
+}
+
+func TestValidateChildModuleOutputs(t *testing.T) {
+	spec, diags := ParseSpec([]byte(`
+assert "module.vpc.output" "subnet_ids" {
+  value = ["subnet-1"]
+}
+
+assert "module.vpc.output" "missing" {
+  value = "x"
+}
+
+reject "module.vpc.output" "vpc_id" {}
+`), "test.tfspec", nil)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	change := &plans.OutputChange{
+		Addr:   addrs.OutputValue{Name: "subnet_ids"}.Absolute(addrs.RootModuleInstance.Child("vpc", addrs.NoKey)),
+		Change: plans.Change{Action: plans.Create, Before: cty.NullVal(cty.DynamicPseudoType), After: cty.ListVal([]cty.Value{cty.StringVal("subnet-1")})},
+	}
+	src, err := change.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := &plans.Plan{Changes: &plans.Changes{Outputs: []*plans.OutputChangeSrc{src}}}
+
+	expected := tfdiags.Diagnostics{
+		SuccessDiags(cty.GetAttrPath("module.vpc.output.subnet_ids").IndexInt(0), "subnet-1"),
+		ErrorDiags(cty.GetAttrPath("module.vpc.output.missing"), "Missing value"),
+		RejectSuccessDiags(cty.GetAttrPath("module.vpc.output.vpc_id"), "Output not planned", nil),
+	}
+	got, err := spec.Validate(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d diagnostics. Got %d : %v", len(expected), len(got), got)
+	}
+	for i := range got {
+		testDiagnostic(t, got[i], expected[i])
+	}
+}
+
+func TestValidateRejectBody(t *testing.T) {
+	spec := readSpecWithSchemas(t, "testdata/scenario_reject.tfspec")
+	if len(spec.Rejects) != 3 {
+		t.Fatalf("Expected 3 rejects. Got %d", len(spec.Rejects))
+	}
+	if !spec.Rejects[2].Value.IsNull() {
+		t.Errorf("Empty reject should have a null value. Got %s", spec.Rejects[2].Value.GoString())
+	}
+
+	ty := spec.Rejects[0].Value.Type()
+	resourceChange := func(name, property, innerProp string) *plans.ResourceInstanceChangeSrc {
+		after := cty.ObjectVal(map[string]cty.Value{
+			"property": cty.StringVal(property),
+			"id":       cty.UnknownVal(cty.Number),
+			"inner":    cty.ObjectVal(map[string]cty.Value{"inner_prop": cty.StringVal(innerProp)}),
+		})
+		change := &plans.ResourceInstanceChange{
+			Addr: addrs.Resource{Mode: addrs.ManagedResourceMode, Type: "ressource_type", Name: name}.
+				Instance(addrs.NoKey).Absolute(addrs.RootModuleInstance),
+			ProviderAddr: addrs.AbsProviderConfig{Module: addrs.RootModule, Provider: addrs.NewDefaultProvider("ressource")},
+			Change:       plans.Change{Action: plans.Create, Before: cty.NullVal(ty), After: after},
+		}
+		src, err := change.Encode(ty)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return src
+	}
+	plan := &plans.Plan{Changes: &plans.Changes{Resources: []*plans.ResourceInstanceChangeSrc{
+		resourceChange("small", "t2.micro", "private"),
+		resourceChange("large", "m5.large", "private"),
+	}}}
+
+	diags, err := spec.Validate(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := tfdiags.Diagnostics{
+		RejectValueErrorDiags(cty.GetAttrPath("ressource_type.small"), cty.StringVal("property"), cty.StringVal("t2.micro"), cty.StringVal("t2.micro")),
+		RejectSuccessDiags(cty.GetAttrPath("ressource_type.large"), "No attribute matching inner definition", nil),
+		RejectSuccessDiags(cty.GetAttrPath("ressource_type.large"), "No attribute matching property definition", nil),
+		RejectSuccessDiags(cty.GetAttrPath("ressource_type.missing"), "Resource not created", nil),
+	}
+	if len(diags) != len(expected) {
+		t.Fatalf("Expected %d diagnostics. Got %d : %v", len(expected), len(diags), diags)
+	}
+	for i := range diags {
+		testDiagnostic(t, diags[i], expected[i])
+	}
+}
+
+func TestParsingTypedValues(t *testing.T) {
+	ruleType := cty.Object(map[string]cty.Type{"port": cty.Number, "cidr": cty.String})
+	schemas := &terraform.Schemas{
+		Providers: map[addrs.Provider]*terraform.ProviderSchema{
+			addrs.NewDefaultProvider("kube"): {
+				ResourceTypes: map[string]*configschema.Block{
+					"kube_manifest": {
+						Attributes: map[string]*configschema.Attribute{
+							"manifest": {Type: cty.DynamicPseudoType},
+							"rules":    {Type: cty.Map(ruleType)},
+						},
+					},
+				},
+			},
+		},
+	}
+	spec, diags := ParseSpec([]byte(`
+assert "kube_manifest" "app" {
+  manifest = {
+    spec = {
+      replicas = 2
+      paused   = "false"
+    }
+  }
+  rules = {
+    http = { port = 80 }
+  }
+}
+`), "test.tfspec", schemas)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	assert := spec.Asserts[0]
+	rules := assert.Value.GetAttr("rules")
+	if !rules.Type().Equals(cty.Map(ruleType)) {
+		t.Fatalf("rules should be converted to the schema type. Got %s", rules.Type().FriendlyName())
+	}
+	if cidr := rules.Index(cty.StringVal("http")).GetAttr("cidr"); !cidr.IsNull() {
+		t.Errorf("missing attributes should be null. Got %s", cidr.GoString())
+	}
+
+	got := cty.ObjectVal(map[string]cty.Value{
+		"manifest": cty.ObjectVal(map[string]cty.Value{
+			"kind": cty.StringVal("Deployment"),
+			"spec": cty.ObjectVal(map[string]cty.Value{
+				"replicas": cty.StringVal("2"),
+				"paused":   cty.False,
+			}),
+		}),
+		"rules": cty.MapVal(map[string]cty.Value{
+			"http": cty.ObjectVal(map[string]cty.Value{"port": cty.NumberIntVal(80), "cidr": cty.StringVal("0.0.0.0/0")}),
+		}),
+	})
+	expected := tfdiags.Diagnostics{
+		SuccessDiags(cty.GetAttrPath("manifest").GetAttr("spec").GetAttr("paused"), false),
+		SuccessDiags(cty.GetAttrPath("manifest").GetAttr("spec").GetAttr("replicas"), "2"),
+		SuccessDiags(cty.GetAttrPath("rules").GetAttr("http").GetAttr("port"), 80),
+	}
+	result := checkAssert(cty.Path{}, assert.Value, got)
+	if len(result) != len(expected) {
+		t.Fatalf("Expected %d diagnostics. Got %d : %v", len(expected), len(result), result)
+	}
+	for i := range result {
+		testDiagnostic(t, result[i], expected[i])
+	}
+}
+
+func TestParsingTypedValuesErrors(t *testing.T) {
+	schemas := &terraform.Schemas{
+		Providers: map[addrs.Provider]*terraform.ProviderSchema{
+			addrs.NewDefaultProvider("kube"): {
+				ResourceTypes: map[string]*configschema.Block{
+					"kube_manifest": {
+						Attributes: map[string]*configschema.Attribute{
+							"rules": {Type: cty.Map(cty.Object(map[string]cty.Type{"port": cty.Number}))},
+						},
+					},
+				},
+			},
+		},
+	}
+	_, diags := ParseSpec([]byte(`
+assert "kube_manifest" "app" {
+  rules = {
+    http = { protocol = "tcp" }
+  }
+}
+`), "test.tfspec", schemas)
+	if !diags.HasErrors() {
+		t.Fatal("Parsing should fail")
+	}
+	if detail := diags[0].Detail; !strings.Contains(detail, `unsupported attribute "protocol"`) {
+		t.Errorf("Unexpected error : %s", detail)
+	}
+}
+
+func TestErrorMessages(t *testing.T) {
+	ty := cty.Object(map[string]cty.Type{"acl": cty.String, "kms_key": cty.String})
+	schemas := &terraform.Schemas{
+		Providers: map[addrs.Provider]*terraform.ProviderSchema{
+			addrs.NewDefaultProvider("aws"): {
+				ResourceTypes: map[string]*configschema.Block{
+					"aws_s3_bucket": {
+						Attributes: map[string]*configschema.Attribute{
+							"acl":     {Type: cty.String, Optional: true},
+							"kms_key": {Type: cty.String, Optional: true},
+						},
+					},
+				},
+			},
+		},
+	}
+	spec, diags := ParseSpec([]byte(`
+assert "aws_s3_bucket" "logs" {
+  error_message = "Buckets follow the storage policy"
+  acl           = "private"
+  kms_key       = because("alias/storage", "S3 buckets must be encrypted with our KMS key")
+}
+
+reject "aws_s3_bucket" "public" {
+  error_message = "Public buckets are forbidden"
+}
+`), "test.tfspec", schemas)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	if message := spec.Asserts[0].ErrorMessage; message != "Buckets follow the storage policy" {
+		t.Errorf("Wrong assert error message : %s", message)
+	}
+	if message := spec.Rejects[0].ErrorMessage; message != "Public buckets are forbidden" {
+		t.Errorf("Wrong reject error message : %s", message)
+	}
+
+	bucket := func(name, acl string) *plans.ResourceInstanceChangeSrc {
+		change := &plans.ResourceInstanceChange{
+			Addr: addrs.Resource{Mode: addrs.ManagedResourceMode, Type: "aws_s3_bucket", Name: name}.
+				Instance(addrs.NoKey).Absolute(addrs.RootModuleInstance),
+			ProviderAddr: addrs.AbsProviderConfig{Module: addrs.RootModule, Provider: addrs.NewDefaultProvider("aws")},
+			Change: plans.Change{Action: plans.Create, Before: cty.NullVal(ty), After: cty.ObjectVal(map[string]cty.Value{
+				"acl":     cty.StringVal(acl),
+				"kms_key": cty.StringVal("alias/default"),
+			})},
+		}
+		src, err := change.Encode(ty)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return src
+	}
+	plan := &plans.Plan{Changes: &plans.Changes{Resources: []*plans.ResourceInstanceChangeSrc{
+		bucket("logs", "public-read"),
+		bucket("public", "public-read"),
+	}}}
+
+	result, err := spec.Validate(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		diag    tfdiags.Diagnostic
+		summary string
+	}{
+		{AssertErrorDiags(cty.GetAttrPath("aws_s3_bucket.logs").GetAttr("acl"), "private", "public-read"), "Buckets follow the storage policy"},
+		{AssertErrorDiags(cty.GetAttrPath("aws_s3_bucket.logs").GetAttr("kms_key"), "alias/storage", "alias/default"), "S3 buckets must be encrypted with our KMS key"},
+		{RejectErrorDiags(cty.GetAttrPath("aws_s3_bucket.public"), spec.Rejects[0], plan.Changes.Resources[1]), "Public buckets are forbidden"},
+	}
+	if len(result) != len(expected) {
+		t.Fatalf("Expected %d diagnostics. Got %d : %v", len(expected), len(result), result)
+	}
+	for i := range result {
+		testDiagnostic(t, result[i], expected[i].diag)
+		if summary := result[i].Description().Summary; summary != expected[i].summary {
+			t.Errorf("Wrong summary. Got %q want %q", summary, expected[i].summary)
+		}
+	}
+}
+
+func TestValidateProviderAsserts(t *testing.T) {
+	spec, diags := ParseSpec([]byte(`
+assert "provider" "aws.eu-west-2" {
+  region = "eu-west-2"
+  assume_role {
+    role_arn = "arn:aws:iam::123456789012:role/deploy"
+  }
+}
+
+assert "provider" "aws" {
+  region        = "eu-west-2"
+  error_message = "The default provider targets London"
+}
+
+assert "provider" "aws.us-east-1" {
+  region = "us-east-1"
+}
+
+assert "provider" "aws.missing" {
+  region = "eu-west-3"
+}
+`), "test.tfspec", providerConfigSchemas)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	plan, recorder, reader := recordedProviderConfigs(t)
+	spec.ConfigRecorder = recorder
+	spec.DataSourceReader = reader
+
+	result, err := spec.Validate(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := tfdiags.Diagnostics{
+		SuccessDiags(cty.GetAttrPath("provider.aws.eu-west-2").GetAttr("assume_role").Index(cty.NumberIntVal(0)).GetAttr("role_arn"), "arn:aws:iam::123456789012:role/deploy"),
+		SuccessDiags(cty.GetAttrPath("provider.aws.eu-west-2").GetAttr("region"), "eu-west-2"),
+		AssertErrorDiags(cty.GetAttrPath("provider.aws").GetAttr("region"), "eu-west-2", "eu-west-1"),
+		SuccessDiags(cty.GetAttrPath("provider.aws.us-east-1").GetAttr("region"), "us-east-1"),
+		ErrorDiags(cty.GetAttrPath("provider.aws.missing"), "No resource or data source planned with this provider"),
+	}
+	if len(result) != len(expected) {
+		t.Fatalf("Expected %d diagnostics. Got %d : %v", len(expected), len(result), result)
+	}
+	for i := range result {
+		testDiagnostic(t, result[i], expected[i])
+	}
+	if summary := result[2].Description().Summary; summary != "The default provider targets London" {
+		t.Errorf("Wrong summary. Got %q", summary)
+	}
+}
+
+func TestValidateAmbiguousProviderAssert(t *testing.T) {
+	spec, diags := ParseSpec([]byte(`
+assert "provider" "aws.eu-west-2" {
+  region = "eu-west-2"
+}
+`), "test.tfspec", providerConfigSchemas)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	plan, _, _ := recordedProviderConfigs(t)
+	spec.ConfigRecorder = &ProviderConfigRecorder{}
+	spec.ConfigRecorder.RecordPlannedResource("aws_s3_bucket", cty.ObjectVal(map[string]cty.Value{"bucket": cty.StringVal("london")}), awsProviderConfig("eu-west-2", ""))
+	spec.ConfigRecorder.RecordPlannedResource("aws_s3_bucket", cty.ObjectVal(map[string]cty.Value{"bucket": cty.StringVal("london")}), awsProviderConfig("eu-west-1", ""))
+
+	result, err := spec.Validate(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 {
+		t.Fatalf("Expected 1 diagnostic. Got %d : %v", len(result), result)
+	}
+	testDiagnostic(t, result[0], ErrorDiags(cty.GetAttrPath("provider.aws.eu-west-2"), "Configuration is ambiguous : other providers planned the same resources with another configuration"))
+}
+
+func TestParsingProviderAssertErrors(t *testing.T) {
+	_, diags := ParseSpec([]byte(`
+assert "provider" "aws" {
+  zone = "eu-west-2a"
+}
+`), "test.tfspec", providerConfigSchemas)
+	if !diags.HasErrors() {
+		t.Fatal("Parsing should fail")
+	}
+	if summary := diags[0].Summary; summary != "Unsupported argument" {
+		t.Errorf("Unexpected error : %s", summary)
+	}
+}
@@ -0,0 +1,183 @@
+package terraspec
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/terraform/addrs"
+	"github.com/hashicorp/terraform/plans"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/hashicorp/terraform/tfdiags"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// tagAttributes are the attributes holding the tags or labels of a resource, in the order they're looked for in its schema.
+// They're only checked when they're a map of strings, like aws tags or google labels
+var tagAttributes = []string{"tags", "labels"}
+
+// TagsPolicy struct contains the tags every planned resource supporting tags or labels must have.
+// Required maps the required keys to their expected value, which can use matchers.
+// Keys neither required nor optional are forbidden, unless AllowOtherKeys is set
+type TagsPolicy struct {
+	Name           string
+	Required       map[string]cty.Value
+	OptionalKeys   []string
+	AllowOtherKeys bool
+	ErrorMessage   string
+}
+
+// tagsPolicySchema is the schema of the body of tags_policy blocks
+var tagsPolicySchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "required"},
+		{Name: "optional_keys"},
+		{Name: "allow_other_keys"},
+		{Name: "error_message"},
+	},
+}
+
+// decodeTagsPolicy reads the body of a tags_policy block
+func decodeTagsPolicy(name string, body hcl.Body, ctx *hcl.EvalContext) (*TagsPolicy, hcl.Diagnostics) {
+	content, diags := body.Content(tagsPolicySchema)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	policy := &TagsPolicy{Name: name, Required: make(map[string]cty.Value)}
+	if attr, ok := content.Attributes["required"]; ok {
+		required, moreDiags := attr.Expr.Value(ctx)
+		diags = append(diags, moreDiags...)
+		if diags.HasErrors() {
+			return nil, diags
+		}
+		if unmarked, _ := required.Unmark(); !unmarked.IsNull() {
+			if !unmarked.IsKnown() || !(unmarked.Type().IsObjectType() || unmarked.Type().IsMapType()) {
+				return nil, diags.Append(&hcl.Diagnostic{Severity: hcl.DiagError, Summary: "Invalid tags_policy", Subject: attr.Expr.Range().Ptr(), Detail: "required must be a map of the required tags to their value"})
+			}
+			for key, val := range unmarked.AsValueMap() {
+				policy.Required[key] = val
+			}
+		}
+	}
+	if attr, ok := content.Attributes["optional_keys"]; ok {
+		diags = append(diags, gohcl.DecodeExpression(attr.Expr, ctx, &policy.OptionalKeys)...)
+	}
+	if attr, ok := content.Attributes["allow_other_keys"]; ok {
+		diags = append(diags, gohcl.DecodeExpression(attr.Expr, ctx, &policy.AllowOtherKeys)...)
+	}
+	if attr, ok := content.Attributes["error_message"]; ok {
+		var moreDiags hcl.Diagnostics
+		policy.ErrorMessage, moreDiags = decodeErrorMessage(attr.Expr, ctx)
+		diags = append(diags, moreDiags...)
+	}
+	if diags.HasErrors() {
+		return nil, diags
+	}
+	return policy, diags
+}
+
+// validateTagsPolicy checks the tags of every planned resource whose schema has tags or labels.
+// It returns one diagnostic per resource, listing all the tags breaking the policy
+func validateTagsPolicy(policy *TagsPolicy, plan *plans.Plan, schemas *terraform.Schemas) (tfdiags.Diagnostics, error) {
+	var diags tfdiags.Diagnostics
+	for _, resource := range plan.Changes.Resources {
+		addr := resource.Addr.Resource.Resource
+		if addr.Mode != addrs.ManagedResourceMode || resource.Action == plans.Delete {
+			continue
+		}
+		schema, _ := schemas.ResourceTypeConfig(resource.ProviderAddr.Provider, addr.Mode, addr.Type)
+		if schema == nil {
+			return nil, fmt.Errorf("Could not find schema of resource %s", resource.Addr.String())
+		}
+		attribute := ""
+		for _, name := range tagAttributes {
+			// other types, like the list of tag blocks of aws_autoscaling_group, aren't supported
+			if attr, ok := schema.Attributes[name]; ok && isStringMap(attr.Type) {
+				attribute = name
+				break
+			}
+		}
+		if attribute == "" {
+			continue
+		}
+		after, err := resource.After.Decode(schema.ImpliedType())
+		if err != nil {
+			return nil, fmt.Errorf("Error happened while decoding planned resource %s : %v", resource.Addr.String(), err)
+		}
+		diags = diags.Append(policy.check(cty.GetAttrPath(resource.Addr.String()).GetAttr(attribute), after.GetAttr(attribute)))
+	}
+	return withErrorMessage(diags, policy.ErrorMessage), nil
+}
+
+// isStringMap indicates if the given type is a map or an object of strings
+func isStringMap(ty cty.Type) bool {
+	if ty.IsMapType() {
+		return ty.ElementType() == cty.String
+	}
+	if !ty.IsObjectType() {
+		return false
+	}
+	for _, attrType := range ty.AttributeTypes() {
+		if attrType != cty.String {
+			return false
+		}
+	}
+	return true
+}
+
+// check compares the planned tags of a resource with the policy
+func (p *TagsPolicy) check(path cty.Path, tags cty.Value) *TerraspecDiagnostic {
+	if !tags.IsKnown() {
+		return UnknownErrorDiags(path, nil)
+	}
+	planned := make(map[string]cty.Value)
+	if !tags.IsNull() && tags.CanIterateElements() {
+		planned = tags.AsValueMap()
+	}
+
+	errors := make([]string, 0)
+	for _, key := range sortedKeys(p.Required) {
+		got, ok := planned[key]
+		if !ok || got.IsNull() {
+			errors = append(errors, fmt.Sprintf("missing tag %q", key))
+			continue
+		}
+		for _, diag := range checkAssert(path.Index(cty.StringVal(key)), p.Required[key], got) {
+			if diag.Severity() == tfdiags.Error {
+				errors = append(errors, fmt.Sprintf("tag %q : %s", key, diag.Description().Detail))
+			}
+		}
+	}
+	if !p.AllowOtherKeys {
+		for _, key := range sortedKeys(planned) {
+			if _, ok := p.Required[key]; !ok && !p.isOptional(key) {
+				errors = append(errors, fmt.Sprintf("unexpected tag %q", key))
+			}
+		}
+	}
+
+	if len(errors) > 0 {
+		return ErrorDiags(path, strings.Join(errors, ", "))
+	}
+	return SuccessDiags(path, "tags match the policy")
+}
+
+func (p *TagsPolicy) isOptional(key string) bool {
+	for _, optional := range p.OptionalKeys {
+		if optional == key {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(values map[string]cty.Value) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
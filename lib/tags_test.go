@@ -0,0 +1,141 @@
+package terraspec
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/addrs"
+	"github.com/hashicorp/terraform/configs/configschema"
+	"github.com/hashicorp/terraform/plans"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/hashicorp/terraform/tfdiags"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestValidateTagsPolicy(t *testing.T) {
+	tests := map[string]struct {
+		policy  string
+		diags   tfdiags.Diagnostics
+		summary string
+	}{
+		"required and optional keys": {
+			policy: `
+tags_policy "default" {
+  required      = { "cost-center" = "ops" }
+  optional_keys = ["env"]
+}`,
+			diags: tfdiags.Diagnostics{
+				SuccessDiags(cty.GetAttrPath(`aws_s3_bucket.this["logs"]`).GetAttr("tags"), "tags match the policy"),
+				ErrorDiags(cty.GetAttrPath(`aws_s3_bucket.this["data"]`).GetAttr("tags"), `missing tag "cost-center"`),
+				ErrorDiags(cty.GetAttrPath("module.storage.aws_s3_bucket.this").GetAttr("tags"), `missing tag "cost-center"`),
+			},
+		},
+		"forbidden keys": {
+			policy: `
+tags_policy "default" {
+  required      = { "cost-center" = known() }
+  error_message = "Resources are tagged with their cost center only"
+}`,
+			diags: tfdiags.Diagnostics{
+				SuccessDiags(cty.GetAttrPath(`aws_s3_bucket.this["logs"]`).GetAttr("tags"), "tags match the policy"),
+				ErrorDiags(cty.GetAttrPath(`aws_s3_bucket.this["data"]`).GetAttr("tags"), `missing tag "cost-center", unexpected tag "env"`),
+				ErrorDiags(cty.GetAttrPath("module.storage.aws_s3_bucket.this").GetAttr("tags"), `missing tag "cost-center"`),
+			},
+			summary: "Resources are tagged with their cost center only",
+		},
+		"wrong values": {
+			policy: `
+tags_policy "default" {
+  required         = { "cost-center" = "finance" }
+  allow_other_keys = true
+}`,
+			diags: tfdiags.Diagnostics{
+				ErrorDiags(cty.GetAttrPath(`aws_s3_bucket.this["logs"]`).GetAttr("tags"), `tag "cost-center" : ops != finance`),
+				ErrorDiags(cty.GetAttrPath(`aws_s3_bucket.this["data"]`).GetAttr("tags"), `missing tag "cost-center"`),
+				ErrorDiags(cty.GetAttrPath("module.storage.aws_s3_bucket.this").GetAttr("tags"), `missing tag "cost-center"`),
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			spec, diags := ParseSpec([]byte(tt.policy), "test.tfspec", checksSchemas)
+			if diags.HasErrors() {
+				t.Fatal(diags)
+			}
+			result, err := spec.Validate(checksPlan(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result) != len(tt.diags) {
+				t.Fatalf("Expected %d diagnostics. Got %d : %v", len(tt.diags), len(result), result)
+			}
+			for i := range result {
+				testDiagnostic(t, result[i], tt.diags[i])
+				if result[i].Severity() == tfdiags.Error && result[i].Description().Summary != tt.summary {
+					t.Errorf("Wrong summary. Got %q want %q", result[i].Description().Summary, tt.summary)
+				}
+			}
+		})
+	}
+}
+
+func TestParsingInvalidTagsPolicy(t *testing.T) {
+	_, diags := ParseSpec([]byte(`
+tags_policy "default" {
+  required = ["cost-center"]
+}
+`), "test.tfspec", checksSchemas)
+	if !diags.HasErrors() {
+		t.Fatal("Parsing should fail")
+	}
+	if diags[0].Summary != "Invalid tags_policy" {
+		t.Errorf("Unexpected error : %s", diags[0].Summary)
+	}
+}
+
+func TestTagsPolicyIgnoresListTags(t *testing.T) {
+	provider := addrs.AbsProviderConfig{Module: addrs.RootModule, Provider: addrs.NewDefaultProvider("aws")}
+	schemas := &terraform.Schemas{
+		Providers: map[addrs.Provider]*terraform.ProviderSchema{
+			provider.Provider: {
+				ResourceTypes: map[string]*configschema.Block{
+					"aws_autoscaling_group": {
+						Attributes: map[string]*configschema.Attribute{
+							"name": {Type: cty.String, Optional: true},
+							"tags": {Type: cty.List(cty.Map(cty.String)), Optional: true},
+						},
+					},
+				},
+			},
+		},
+	}
+	ty := schemas.Providers[provider.Provider].ResourceTypes["aws_autoscaling_group"].ImpliedType()
+	change := &plans.ResourceInstanceChange{
+		Addr:         addrs.Resource{Mode: addrs.ManagedResourceMode, Type: "aws_autoscaling_group", Name: "this"}.Instance(addrs.NoKey).Absolute(addrs.RootModuleInstance),
+		ProviderAddr: provider,
+		Change: plans.Change{Action: plans.Create, Before: cty.NullVal(ty), After: cty.ObjectVal(map[string]cty.Value{
+			"name": cty.StringVal("web"),
+			"tags": cty.ListVal([]cty.Value{cty.MapVal(map[string]cty.Value{"key": cty.StringVal("env"), "value": cty.StringVal("prod")})}),
+		})},
+	}
+	src, err := change.Encode(ty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec, diags := ParseSpec([]byte(`
+tags_policy "default" {
+  required = { "cost-center" = "ops" }
+}
+`), "test.tfspec", schemas)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+	result, err := spec.Validate(&plans.Plan{Changes: &plans.Changes{Resources: []*plans.ResourceInstanceChangeSrc{src}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 0 {
+		t.Errorf("Tags that aren't a map of strings shouldn't be checked. Got %v", result)
+	}
+}
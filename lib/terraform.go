@@ -4,16 +4,19 @@ import (
 	"fmt"
 	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/hcldec"
 	"github.com/hashicorp/terraform/addrs"
 	"github.com/hashicorp/terraform/configs"
 	"github.com/hashicorp/terraform/configs/configload"
+	"github.com/hashicorp/terraform/lang"
 	"github.com/hashicorp/terraform/terraform"
 	"github.com/hashicorp/terraform/tfdiags"
 	"github.com/hashicorp/terraform/version"
 	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
 
 	goversion "github.com/hashicorp/go-version"
 )
@@ -68,6 +71,7 @@ func BuildContextOptions(dir, varFile string, resolver *ProviderResolver, tsCtx
 		Providers:    providers,
 		Provisioners: ProvisionersFactory(),
 		Variables:    variables,
+		Hooks:        []terraform.Hook{&DataSourceHook{Reader: resolver.DataSourceReader}},
 		Meta: &terraform.ContextMeta{
 			Env: "",
 		},
@@ -112,6 +116,31 @@ func InputValuesFromType(values map[string]cty.Value, sourceType terraform.Value
 	return vals
 }
 
+// InputVariableValues returns the values of the input variables of the root module :
+// the given values, or the default values of the variables declared in cfg
+func InputVariableValues(cfg *configs.Config, values terraform.InputValues) map[string]cty.Value {
+	vals := make(map[string]cty.Value)
+	if cfg != nil && cfg.Module != nil {
+		for name, v := range cfg.Module.Variables {
+			if v.Default != cty.NilVal {
+				vals[name] = v.Default
+			}
+		}
+	}
+	for name, v := range values {
+		val := v.Value
+		if cfg != nil && cfg.Module != nil {
+			if decl, ok := cfg.Module.Variables[name]; ok {
+				if converted, err := convert.Convert(val, decl.Type); err == nil {
+					val = converted
+				}
+			}
+		}
+		vals[name] = val
+	}
+	return vals
+}
+
 // LookupProviderSchema searches for the schema matching the given type in the collection of known schemas
 func LookupProviderSchema(schemas *terraform.Schemas, providerType string) (*terraform.ProviderSchema, error) {
 	for k, v := range schemas.Providers {
@@ -122,18 +151,116 @@ func LookupProviderSchema(schemas *terraform.Schemas, providerType string) (*ter
 	return nil, fmt.Errorf("unknown provider \"%s\"", providerType)
 }
 
+// ProvidersMapFromConfig decodes the provider configurations of the whole configuration tree.
+// Root module providers are keyed by their name and alias, eg "aws.eu-west-2", and providers of child modules
+// are prefixed by the module path, eg "module.network.aws". A child module gets the configurations passed with its
+// providers argument, or inherits the default ones of its parent
 func ProvidersMapFromConfig(cfg configs.Config, schema *terraform.Schemas) map[string]cty.Value {
 	provMap := make(map[string]cty.Value)
-	if m := cfg.Module; m != nil {
-		for alias, provCfg := range m.ProviderConfigs {
-			s := providerSchema(schema, provCfg.Addr())
-			if s != nil {
-				b, _ := hcldec.Decode(provCfg.Config, s.Provider.DecoderSpec(), &hcl.EvalContext{})
-				provMap[alias] = b
+	addProviderConfigs(&cfg, schema, provMap, &hcl.EvalContext{})
+	return provMap
+}
+
+// EvalProvidersMapFromConfig decodes the provider configurations like ProvidersMapFromConfig, but evaluates them with
+// the given values of the root module variables. Variables of child modules are evaluated from the arguments of their
+// module call. Configurations depending on values only known while planning, like resource attributes, are not wholly known
+func EvalProvidersMapFromConfig(cfg *configs.Config, schema *terraform.Schemas, variables map[string]cty.Value) map[string]cty.Value {
+	provMap := make(map[string]cty.Value)
+	if cfg != nil && cfg.Module != nil {
+		addProviderConfigs(cfg, schema, provMap, providerEvalContext(cfg.Module, variables))
+	}
+	return provMap
+}
+
+func addProviderConfigs(cfg *configs.Config, schema *terraform.Schemas, provMap map[string]cty.Value, ctx *hcl.EvalContext) {
+	m := cfg.Module
+	if m == nil {
+		return
+	}
+	prefix := providerPrefix(cfg.Path)
+	for alias, provCfg := range m.ProviderConfigs {
+		s := providerSchema(schema, provCfg.Addr())
+		if s != nil {
+			b, _ := hcldec.Decode(provCfg.Config, s.Provider.DecoderSpec(), ctx)
+			provMap[prefix+alias] = b
+		}
+	}
+
+	for name, child := range cfg.Children {
+		childPrefix := providerPrefix(child.Path)
+		call, ok := m.ModuleCalls[name]
+		if ok && len(call.Providers) > 0 {
+			for _, passed := range call.Providers {
+				if v, ok := provMap[prefix+passed.InParent.String()]; ok {
+					provMap[childPrefix+passed.InChild.String()] = v
+				}
+			}
+		} else {
+			// without providers argument, a child module inherits the default providers of its parent
+			inherited := make(map[string]cty.Value)
+			for key, v := range provMap {
+				if name := strings.TrimPrefix(key, prefix); strings.HasPrefix(key, prefix) && !strings.Contains(name, ".") {
+					inherited[childPrefix+name] = v
+				}
 			}
+			for key, v := range inherited {
+				provMap[key] = v
+			}
+		}
+		childCtx := &hcl.EvalContext{}
+		// variables are only known when the root module ones were given
+		if ctx.Variables != nil && ok && child.Module != nil {
+			childCtx = providerEvalContext(child.Module, moduleCallArguments(call, ctx))
 		}
+		addProviderConfigs(child, schema, provMap, childCtx)
 	}
-	return provMap
+}
+
+// providerEvalContext returns the context provider configurations of the given module are evaluated with :
+// the given values of its variables, or their default value, and the functions of terraform.
+// Variables without value are unknown
+func providerEvalContext(module *configs.Module, values map[string]cty.Value) *hcl.EvalContext {
+	vars := make(map[string]cty.Value, len(module.Variables))
+	for name, decl := range module.Variables {
+		val, ok := values[name]
+		if !ok || val.IsNull() {
+			val = decl.Default
+		}
+		if val.Type() == cty.NilType {
+			val = cty.UnknownVal(decl.Type)
+		}
+		if converted, err := convert.Convert(val, decl.Type); err == nil {
+			val = converted
+		}
+		vars[name] = val
+	}
+	return &hcl.EvalContext{
+		Variables: map[string]cty.Value{"var": cty.ObjectVal(vars)},
+		Functions: (&lang.Scope{BaseDir: module.SourceDir}).Functions(),
+	}
+}
+
+// moduleCallArguments evaluates the arguments of a module call with the context of the calling module.
+// Arguments that can't be evaluated, like the ones depending on resources, are unknown
+func moduleCallArguments(call *configs.ModuleCall, ctx *hcl.EvalContext) map[string]cty.Value {
+	values := make(map[string]cty.Value)
+	attrs, _ := call.Config.JustAttributes()
+	for name, attr := range attrs {
+		val, diags := attr.Expr.Value(ctx)
+		if diags.HasErrors() {
+			val = cty.DynamicVal
+		}
+		values[name] = val
+	}
+	return values
+}
+
+// providerPrefix returns the prefix of the provider configurations of the given module
+func providerPrefix(path addrs.Module) string {
+	if path.IsRoot() {
+		return ""
+	}
+	return path.String() + "."
 }
 
 func providerSchema(schema *terraform.Schemas, addr addrs.LocalProviderConfig) *terraform.ProviderSchema {
@@ -0,0 +1,126 @@
+package terraspec
+
+import (
+	"path/filepath"
+	"testing"
+
+	goversion "github.com/hashicorp/go-version"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/terraform/addrs"
+	"github.com/hashicorp/terraform/configs"
+	"github.com/hashicorp/terraform/configs/configschema"
+	"github.com/hashicorp/terraform/terraform"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func loadTestConfig(t *testing.T, dir string) *configs.Config {
+	parser := configs.NewParser(nil)
+	root, diags := parser.LoadConfigDir(dir)
+	if diags.HasErrors() {
+		t.Fatal(diags.Error())
+	}
+	cfg, diags := configs.BuildConfig(root, configs.ModuleWalkerFunc(func(req *configs.ModuleRequest) (*configs.Module, *goversion.Version, hcl.Diagnostics) {
+		mod, diags := parser.LoadConfigDir(filepath.Join(req.Parent.Module.SourceDir, req.SourceAddr))
+		return mod, nil, diags
+	}))
+	if diags.HasErrors() {
+		t.Fatal(diags.Error())
+	}
+	return cfg
+}
+
+func TestProvidersMapFromConfig(t *testing.T) {
+	cfg := loadTestConfig(t, "testdata/providers")
+	schemas := &terraform.Schemas{
+		Providers: map[addrs.Provider]*terraform.ProviderSchema{
+			addrs.NewDefaultProvider("aws"): {
+				Provider: &configschema.Block{
+					Attributes: map[string]*configschema.Attribute{
+						"region": {Type: cty.String, Optional: true},
+					},
+				},
+			},
+		},
+	}
+	region := func(name string) cty.Value {
+		return cty.ObjectVal(map[string]cty.Value{"region": cty.StringVal(name)})
+	}
+
+	expected := map[string]cty.Value{
+		"aws":                              region("eu-west-1"),
+		"aws.eu-west-2":                    region("eu-west-2"),
+		"module.network.aws":               region("eu-west-2"),
+		"module.network.aws.us":            region("us-east-1"),
+		"module.network.module.nested.aws": region("us-east-1"),
+		"module.inherit.aws":               region("eu-west-1"),
+	}
+
+	got := ProvidersMapFromConfig(*cfg, schemas)
+	if len(got) != len(expected) {
+		t.Errorf("Expected %d provider configurations. Got %v", len(expected), got)
+	}
+	for key, value := range expected {
+		if !got[key].RawEquals(value) {
+			t.Errorf("Unexpected configuration for %s. Got %v", key, got[key].GoString())
+		}
+	}
+}
+
+func TestEvalProvidersMapFromConfig(t *testing.T) {
+	cfg := loadTestConfig(t, "testdata/providers_variables")
+	schemas := &terraform.Schemas{
+		Providers: map[addrs.Provider]*terraform.ProviderSchema{
+			addrs.NewDefaultProvider("aws"): {
+				Provider: &configschema.Block{
+					Attributes: map[string]*configschema.Attribute{
+						"region": {Type: cty.String, Optional: true},
+					},
+				},
+			},
+		},
+	}
+	region := func(name string) cty.Value {
+		return cty.ObjectVal(map[string]cty.Value{"region": cty.StringVal(name)})
+	}
+
+	got := EvalProvidersMapFromConfig(cfg, schemas, map[string]cty.Value{"backup_region": cty.StringVal("eu-west-2")})
+	expected := map[string]cty.Value{
+		"aws":                        region("eu-west-1"),
+		"aws.backup":                 region("eu-west-2"),
+		"module.network.aws":         region("eu-west-1"),
+		"module.network.aws.network": region("eu-west-2"),
+		"module.computed.aws":        region("eu-west-1"),
+	}
+	for key, value := range expected {
+		if !got[key].RawEquals(value) {
+			t.Errorf("Unexpected configuration for %s. Got %v", key, got[key].GoString())
+		}
+	}
+	// configurations depending on resources are only known while planning
+	for _, key := range []string{"aws.computed", "module.computed.aws.network"} {
+		if config, ok := got[key]; !ok || config.IsWhollyKnown() {
+			t.Errorf("Configuration of %s shouldn't be known. Got %v", key, config.GoString())
+		}
+	}
+}
+
+func TestInputVariableValues(t *testing.T) {
+	cfg := loadTestConfig(t, "testdata/variables")
+
+	got := InputVariableValues(cfg, terraform.InputValues{
+		"instances": {Value: cty.StringVal("3"), SourceType: terraform.ValueFromNamedFile},
+	})
+
+	expected := map[string]cty.Value{
+		"env":       cty.StringVal("dev"),
+		"instances": cty.NumberIntVal(3),
+	}
+	if len(got) != len(expected) {
+		t.Errorf("Expected %d variables. Got %v", len(expected), got)
+	}
+	for name, value := range expected {
+		if !got[name].RawEquals(value) {
+			t.Errorf("Unexpected value for %s. Got %v", name, got[name].GoString())
+		}
+	}
+}
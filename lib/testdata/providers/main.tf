@@ -0,0 +1,19 @@
+provider "aws" {
+  region = "eu-west-1"
+}
+
+provider "aws" {
+  alias  = "eu-west-2"
+  region = "eu-west-2"
+}
+
+module "network" {
+  source = "./modules/network"
+  providers = {
+    aws = aws.eu-west-2
+  }
+}
+
+module "inherit" {
+  source = "./modules/region"
+}
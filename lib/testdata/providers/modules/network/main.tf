@@ -0,0 +1,11 @@
+provider "aws" {
+  alias  = "us"
+  region = "us-east-1"
+}
+
+module "nested" {
+  source = "../region"
+  providers = {
+    aws = aws.us
+  }
+}
@@ -0,0 +1 @@
+data "aws_region" "current" {}
@@ -0,0 +1,9 @@
+variable "region" {}
+
+provider "aws" {
+  alias  = "eu-west-2"
+  region = var.region
+  assume_role {
+    role_arn = "arn:aws:iam::123456789012:role/deploy"
+  }
+}
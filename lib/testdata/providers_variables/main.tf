@@ -0,0 +1,33 @@
+variable "region" {
+  default = "eu-west-1"
+}
+
+variable "backup_region" {}
+
+provider "aws" {
+  region = var.region
+}
+
+provider "aws" {
+  alias  = "backup"
+  region = var.backup_region
+}
+
+provider "aws" {
+  alias  = "computed"
+  region = aws_s3_bucket.config.region
+}
+
+resource "aws_s3_bucket" "config" {
+  bucket = "config"
+}
+
+module "network" {
+  source = "./modules/network"
+  region = upper(var.backup_region)
+}
+
+module "computed" {
+  source = "./modules/network"
+  region = aws_s3_bucket.config.region
+}
@@ -0,0 +1,6 @@
+variable "region" {}
+
+provider "aws" {
+  alias  = "network"
+  region = lower(var.region)
+}
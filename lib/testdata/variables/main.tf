@@ -0,0 +1,9 @@
+variable "env" {
+  default = "dev"
+}
+
+variable "instances" {
+  type = number
+}
+
+variable "region" {}
@@ -12,8 +12,10 @@ import (
 	"time"
 
 	goversion "github.com/hashicorp/go-version"
+	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/terraform/backend/local"
 	"github.com/hashicorp/terraform/helper/logging"
+	"github.com/hashicorp/terraform/plans"
 	"github.com/hashicorp/terraform/terraform"
 	"github.com/hashicorp/terraform/tfdiags"
 	tfversion "github.com/hashicorp/terraform/version"
@@ -33,6 +35,9 @@ var (
 	displayPlan       = app.Flag("display-plan", "Print the full plan before the results").Default("false").Bool()
 	tfVersion         = app.Flag("claim-version", "Simulate terraform version : This flag is a workaround to help upgrading terraspec and terraform independently. This flag won't change terraspec behavior but will make it pass version check").String()
 	configureProvider = app.Flag("configure-provider", "Execute provider plugin configuration. Required for aws > 3.0").Default("false").Bool()
+
+	runCmd      = app.Command("run", "Run all test cases found in the spec folder").Default()
+	generateCmd = app.Command("generate", "Generate a starter tfspec in the spec folder from the current plan")
 )
 
 func init() {
@@ -43,15 +48,20 @@ Terraform Version : %s`
 
 func main() {
 
-	kingpin.MustParse(app.Parse(os.Args[1:]))
-
-	exitCode := execTerraspec(*specDir, *displayPlan, *tfVersion, *configureProvider)
+	var exitCode int
+	switch kingpin.MustParse(app.Parse(os.Args[1:])) {
+	case generateCmd.FullCommand():
+		exitCode = execGenerate(*specDir, *tfVersion, *configureProvider)
+	case runCmd.FullCommand():
+		exitCode = execTerraspec(*specDir, *displayPlan, *tfVersion, *configureProvider)
+	}
 
 	os.Exit(exitCode)
 }
 
 type testCase struct {
 	dir          string
+	rootDir      string
 	variableFile string
 	specFile     string
 }
@@ -66,7 +76,7 @@ type testReport struct {
 	report tfdiags.Diagnostics
 }
 
-func execTerraspec(specDir string, displayPlan bool, tfVersion string, configureProvider bool) int {
+func newTerraspecContext(tfVersion string, configureProvider bool) *terraspec.Context {
 	var newSemVer *goversion.Version
 	var err error
 	if tfVersion != "" {
@@ -76,7 +86,11 @@ func execTerraspec(specDir string, displayPlan bool, tfVersion string, configure
 		}
 	}
 
-	tsCtx := &terraspec.Context{TerraformVersion: tfversion.SemVer, UserVersion: newSemVer, ConfigureProvider: configureProvider}
+	return &terraspec.Context{TerraformVersion: tfversion.SemVer, UserVersion: newSemVer, ConfigureProvider: configureProvider}
+}
+
+func execTerraspec(specDir string, displayPlan bool, tfVersion string, configureProvider bool) int {
+	tsCtx := newTerraspecContext(tfVersion, configureProvider)
 
 	log.SetFlags(0)
 
@@ -130,22 +144,54 @@ func execTerraspec(specDir string, displayPlan bool, tfVersion string, configure
 	return exitCode
 }
 
-func runTestCase(tc *testCase, tsCtx *terraspec.Context, displayPlan bool, results chan<- *testReport) {
+func execGenerate(specDir string, tfVersion string, configureProvider bool) int {
+	tsCtx := newTerraspecContext(tfVersion, configureProvider)
+
+	log.SetFlags(0)
+
+	if tc := findCase(specDir); tc != nil {
+		log.Fatalf("%s already contains a spec file : %s\n", specDir, tc.specFile)
+	}
+	if err := os.MkdirAll(specDir, 0755); err != nil {
+		log.Fatalf("Could not create %s directory : %v\n", specDir, err)
+	}
+	// the generated test case gets the shared mocks of the folder holding it, like the other test cases
+	tc := &testCase{dir: specDir, rootDir: filepath.Dir(specDir), variableFile: findVariableFile(specDir)}
+
 	// Disable terraform verbose logging except if TF_LOG is set
 	logging.SetOutput()
-	var planOutput string
+	tfCtx, spec, plan, ctxDiags := planTestCase(tc, tsCtx)
+	log.SetOutput(os.Stderr)
+	if ctxDiags.HasErrors() {
+		printDiags(ctxDiags)
+		return 1
+	}
+
+	generated, err := terraspec.GenerateSpec(plan, tfCtx.Schemas(), spec.DataSourceReader.UnmatchedCalls())
+	if err != nil {
+		log.Fatalf("Could not generate spec : %v\n", err)
+	}
+	specFile := filepath.Join(specDir, fmt.Sprintf("%s.tfspec", tc.name()))
+	if err := ioutil.WriteFile(specFile, generated, 0644); err != nil {
+		log.Fatalf("Could not write %s : %v\n", specFile, err)
+	}
+	fmt.Printf("📝 %s generated\n", specFile)
+	return 0
+}
 
+// planTestCase computes the terraform plan of the given test case.
+// Returned diagnostics may contain errors
+func planTestCase(tc *testCase, tsCtx *terraspec.Context) (*terraform.Context, *terraspec.Spec, *plans.Plan, tfdiags.Diagnostics) {
 	tfCtx, spec, ctxDiags := PrepareTestSuite(".", tc, tsCtx)
-	if fatalReport(tc.name(), ctxDiags, planOutput, results) {
-		return
+	if ctxDiags.HasErrors() {
+		return nil, nil, nil, ctxDiags
 	}
 	// Refresh is required to have datasources read
 	_, refreshDiags := tfCtx.Refresh()
 	ctxDiags = ctxDiags.Append(refreshDiags)
 	if ctxDiags.HasErrors() {
 		ctxDiags = ctxDiags.Append(spec.ValidateMocks())
-		fatalReport(tc.name(), ctxDiags, planOutput, results)
-		return
+		return nil, nil, nil, ctxDiags
 	}
 
 	// A first apply is required to have a resource state initiated.
@@ -157,6 +203,15 @@ func runTestCase(tc *testCase, tsCtx *terraspec.Context, displayPlan bool, resul
 	plan, planDiags := tfCtx.Plan()
 	ctxDiags = ctxDiags.Append(planDiags)
 	ctxDiags = ctxDiags.Append(spec.ValidateMocks())
+	return tfCtx, spec, plan, ctxDiags
+}
+
+func runTestCase(tc *testCase, tsCtx *terraspec.Context, displayPlan bool, results chan<- *testReport) {
+	// Disable terraform verbose logging except if TF_LOG is set
+	logging.SetOutput()
+	var planOutput string
+
+	tfCtx, spec, plan, ctxDiags := planTestCase(tc, tsCtx)
 	if fatalReport(tc.name(), ctxDiags, planOutput, results) {
 		return
 	}
@@ -215,7 +270,22 @@ func PrepareTestSuite(dir string, tc *testCase, tsCtx *terraspec.Context) (*terr
 	}
 
 	// Parse specs may return mocked data source result
-	spec, diags := terraspec.ReadSpec(tc.specFile, schemas)
+	// A test case without spec file, like the one being generated, runs with the shared specs only
+	var spec *terraspec.Spec
+	specOptions := &terraspec.SpecOptions{
+		Variables: terraspec.InputVariableValues(tfCtxOpts.Config, tfCtxOpts.Variables),
+		RootDir:   tc.rootDir,
+	}
+	if tc.specFile != "" {
+		spec, diags = terraspec.ReadSpecWithOptions(tc.specFile, schemas, specOptions)
+	} else {
+		var hclDiags hcl.Diagnostics
+		spec, hclDiags = terraspec.ParseSpecWithOptions(nil, "", schemas, specOptions)
+		diags = diags.Append(hclDiags)
+		if !diags.HasErrors() {
+			diags = diags.Append(spec.IncludeShared(schemas, specOptions))
+		}
+	}
 	ctxDiags = ctxDiags.Append(diags)
 	if ctxDiags.HasErrors() {
 		return nil, nil, ctxDiags
@@ -225,13 +295,20 @@ func PrepareTestSuite(dir string, tc *testCase, tsCtx *terraspec.Context) (*terr
 	tfCtxOpts.Meta.Env = spec.Terraspec.Workspace
 
 	//If spec contains mocked data source results, they must be provided to the DataSourceReader
+	if spec.Terraspec.AutoMock {
+		providerResolver.DataSourceReader.SetAutoMock(schemas)
+	}
 	if len(spec.Mocks) > 0 {
 		providerResolver.DataSourceReader.SetMock(spec.Mocks)
-		provMap := terraspec.ProvidersMapFromConfig(*tfCtxOpts.Config, schemas)
+	}
+	if len(spec.Mocks) > 0 || len(spec.DataAsserts) > 0 {
+		provMap := terraspec.EvalProvidersMapFromConfig(tfCtxOpts.Config, schemas, specOptions.Variables)
 		providerResolver.DataSourceReader.SetProviderConfig(provMap)
 	}
 	providerResolver.ResourceCreator.SetFakes(spec.Asserts)
 	spec.DataSourceReader = providerResolver.DataSourceReader
+	providerResolver.ConfigRecorder.SetConfig(tfCtxOpts.Config)
+	spec.ConfigRecorder = providerResolver.ConfigRecorder
 
 	// this is the actual tf context we use for testing
 	tfCtx, diags := terraform.NewContext(tfCtxOpts)
@@ -252,14 +329,17 @@ func findCases(rootDir string) []*testCase {
 	}
 
 	for _, rootFi := range rootFis {
-		if !rootFi.IsDir() {
+		// the shared folder only contains spec files included in the other test cases
+		if !rootFi.IsDir() || rootFi.Name() == terraspec.SharedDir {
 			continue
 		}
 		if testCase := findCase(filepath.Join(rootDir, rootFi.Name())); testCase != nil {
+			testCase.rootDir = rootDir
 			testCases = append(testCases, testCase)
 		}
 	}
 	if testCase := findCase(rootDir); testCase != nil {
+		testCase.rootDir = filepath.Dir(rootDir)
 		testCases = append(testCases, testCase)
 	}
 	return testCases
@@ -270,24 +350,35 @@ func findCase(rootDir string) *testCase {
 	if err != nil {
 		return nil
 	}
-	var varFile, specFile string
+	var specFile string
 	for _, fi := range fis {
 		if fi.IsDir() {
 			continue
 		}
-		if filepath.Ext(fi.Name()) == ".tfvars" {
-			varFile = filepath.Join(rootDir, fi.Name())
-		}
 		if filepath.Ext(fi.Name()) == ".tfspec" {
 			specFile = filepath.Join(rootDir, fi.Name())
 		}
 	}
 	if specFile != "" {
-		return &testCase{dir: rootDir, variableFile: varFile, specFile: specFile}
+		return &testCase{dir: rootDir, variableFile: findVariableFile(rootDir), specFile: specFile}
 	}
 	return nil
 }
 
+func findVariableFile(rootDir string) string {
+	fis, err := ioutil.ReadDir(rootDir)
+	if err != nil {
+		return ""
+	}
+	var varFile string
+	for _, fi := range fis {
+		if !fi.IsDir() && filepath.Ext(fi.Name()) == ".tfvars" {
+			varFile = filepath.Join(rootDir, fi.Name())
+		}
+	}
+	return varFile
+}
+
 func fatalReport(name string, err tfdiags.Diagnostics, plan string, reports chan<- *testReport) bool {
 	if err.HasErrors() {
 		reports <- &testReport{name: name, report: err, plan: plan}
@@ -300,19 +391,27 @@ func printDiags(ctxDiags tfdiags.Diagnostics) {
 	for _, diag := range ctxDiags {
 		switch d := diag.(type) {
 		case *terraspec.TerraspecDiagnostic:
-			if diag.Severity() == terraspec.Info {
+			switch diag.Severity() {
+			case terraspec.Info:
 				fmt.Print(" ✔  ")
-			} else {
+			case tfdiags.Warning:
+				fmt.Print(" ⚠  ")
+			default:
 				fmt.Print(" ❌  ")
 			}
 			if path := tfdiags.GetAttribute(d.Diagnostic); path != nil {
 				colorstring.Printf("[bold]%s ", formatPath(path))
 			}
-			if diag.Severity() == terraspec.Info {
+			switch diag.Severity() {
+			case terraspec.Info:
 				colorstring.Printf("= [green]%s\n", diag.Description().Detail)
-			} else {
+			case tfdiags.Warning:
+				colorstring.Printf(": [yellow]%s\n", diag.Description().Detail)
+			default:
 				colorstring.Printf(": [red]%s\n", diag.Description().Detail)
-
+				if summary := diag.Description().Summary; summary != "" {
+					colorstring.Printf("    [red]↳ %s\n", summary)
+				}
 			}
 
 		default:
@@ -340,8 +439,11 @@ func formatPath(path cty.Path) string {
 			sb.WriteString(p.Name)
 		case cty.IndexStep:
 			sb.WriteRune('[')
-			val, _ := p.Key.AsBigFloat().Int64()
-			sb.WriteString(strconv.Itoa(int(val)))
+			if p.Key.Type() == cty.String {
+				sb.WriteString(strconv.Quote(p.Key.AsString()))
+			} else {
+				sb.WriteString(p.Key.AsBigFloat().Text('f', -1))
+			}
 			sb.WriteRune(']')
 		}
 	}